@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Alias maps a model name that clients hard-code (e.g. "gpt-4o-mini") to an
+// ordered list of local models. A chat call tries each target in turn until
+// one succeeds. Targets may be presets, but not other aliases.
+type Alias struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Targets   []string  `json:"targets"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (a *Alias) validate() error {
+	if strings.TrimSpace(a.Name) == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(a.Targets) == 0 {
+		return fmt.Errorf("at least one target model is required")
+	}
+	for i, t := range a.Targets {
+		if strings.TrimSpace(t) == "" {
+			return fmt.Errorf("targets.%d: model name must not be empty", i)
+		}
+		if t == a.Name {
+			return fmt.Errorf("targets.%d: an alias cannot point to itself", i)
+		}
+	}
+	return nil
+}
+
+// checkChaining rejects an alias that would point at another alias, or that
+// another alias already points at: targets are never resolved a second time,
+// so the inner alias name would reach the backend and fail there.
+func (a *Alias) checkChaining(db *DB) error {
+	for i, t := range a.Targets {
+		other, err := db.GetAlias(t)
+		if err != nil {
+			return err
+		}
+		if other != nil && other.ID != a.ID {
+			return fmt.Errorf("targets.%d: %q is an alias; aliases cannot point to other aliases", i, t)
+		}
+	}
+	aliases, err := db.ListAliases()
+	if err != nil {
+		return err
+	}
+	name := normalizeModelName(a.Name)
+	for _, other := range aliases {
+		if other.ID == a.ID {
+			continue
+		}
+		for _, t := range other.Targets {
+			if normalizeModelName(t) == name {
+				return fmt.Errorf("alias %q already uses %q as a target; aliases cannot point to other aliases", other.Name, a.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// chatTarget is one model a chat call may be served by.
+type chatTarget struct {
+	Model     string // reported to the client as the model that served the call
+	preset    *Preset
+	keepAlive string // the upstream model's configured keep-alive
+}
+
+// request builds the upstream call for this target from the client's request.
+func (t chatTarget) request(req ChatRequest) ChatRequest {
+	req.Model = t.Model
+	req.Options = maps.Clone(req.Options) // a preset fills in defaults
+	t.preset.apply(&req)
+	if req.KeepAlive == "" {
+		req.KeepAlive = t.keepAlive
+	}
+	return req
+}
+
+// chatTargets is the ordered fallback chain for a chat call.
+type chatTargets []chatTarget
+
+// resolveChatTargets expands the requested model into the models to try: an
+// alias's targets, or the model itself. Presets and keep-alive settings are
+// looked up for each. Targets the caller may not use, whether by name or by
+// a preset's base model, are skipped, so the result is empty when none is left.
+func resolveChatTargets(ctx context.Context, db *DB, model string) (chatTargets, error) {
+	alias, err := db.GetAlias(model)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{model}
+	if alias != nil {
+		names = alias.Targets
+	}
+
+	var targets chatTargets
+	for _, name := range names {
+		if alias != nil && !modelPermitted(ctx, name) {
+			continue
+		}
+		preset, err := db.GetPreset(name)
+		if err != nil {
+			return nil, err
+		}
+		upstream := name
+		if preset != nil {
+			upstream = preset.BaseModel
+		}
+		if !modelPermitted(ctx, upstream) {
+			continue
+		}
+		settings, err := db.GetModelSettings(upstream)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, chatTarget{Model: name, preset: preset, keepAlive: settings.keepAlive()})
+	}
+	return targets, nil
+}
+
+// Chat tries each target in turn and returns the first successful response
+// along with the model that served it.
+func (ts chatTargets) Chat(ctx context.Context, backend Backend, req ChatRequest) (*ChatResponse, string, error) {
+	var err error
+	for i, t := range ts {
+		var resp *ChatResponse
+		resp, err = backend.Chat(ctx, t.request(req))
+		if err == nil {
+			return resp, t.Model, nil
+		}
+		if ctx.Err() != nil {
+			return nil, t.Model, err
+		}
+		if i < len(ts)-1 {
+			log.Printf("Model %s failed, falling back to %s: %v", t.Model, ts[i+1].Model, err)
+		}
+	}
+	return nil, ts[len(ts)-1].Model, err
+}
+
+// ChatStream streams from the first target that works. It only falls back
+// while nothing has been streamed yet; onChunk is told which model is serving.
+func (ts chatTargets) ChatStream(ctx context.Context, backend Backend, req ChatRequest, onChunk func(model string, chunk StreamChunk) error) (string, error) {
+	var err error
+	for i, t := range ts {
+		started := false
+		err = backend.ChatStream(ctx, t.request(req), func(chunk StreamChunk) error {
+			started = true
+			return onChunk(t.Model, chunk)
+		})
+		if err == nil || started || ctx.Err() != nil {
+			return t.Model, err
+		}
+		if i < len(ts)-1 {
+			log.Printf("Model %s failed, falling back to %s: %v", t.Model, ts[i+1].Model, err)
+		}
+	}
+	return ts[len(ts)-1].Model, err
+}
+
+// --- Database methods ---
+
+const aliasColumns = `id, name, targets, created_at, updated_at`
+
+func scanAlias(row interface{ Scan(...any) error }) (*Alias, error) {
+	var a Alias
+	var targets string
+	if err := row.Scan(&a.ID, &a.Name, &targets, &a.CreatedAt, &a.UpdatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(targets), &a.Targets); err != nil {
+		return nil, fmt.Errorf("decoding targets of alias %q: %w", a.Name, err)
+	}
+	return &a, nil
+}
+
+// CreateAlias stores a new alias.
+func (db *DB) CreateAlias(a *Alias) error {
+	targets, _ := json.Marshal(a.Targets)
+	result, err := db.conn.Exec(`
+		INSERT INTO model_aliases (name, targets) VALUES (?, ?)
+	`, a.Name, string(targets))
+	if err != nil {
+		return fmt.Errorf("inserting alias: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	a.ID = int(id)
+	a.CreatedAt = time.Now().UTC()
+	a.UpdatedAt = a.CreatedAt
+	return nil
+}
+
+// UpdateAlias replaces the name and targets of an existing alias.
+func (db *DB) UpdateAlias(a *Alias) error {
+	targets, _ := json.Marshal(a.Targets)
+	result, err := db.conn.Exec(`
+		UPDATE model_aliases SET name = ?, targets = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, a.Name, string(targets), a.ID)
+	if err != nil {
+		return fmt.Errorf("updating alias: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetAlias looks up an alias by the model name a client asked for. Returns
+// nil if there is no such alias.
+func (db *DB) GetAlias(model string) (*Alias, error) {
+	a, err := scanAlias(db.conn.QueryRow(`
+		SELECT `+aliasColumns+` FROM model_aliases WHERE name = ? OR name || ':latest' = ?
+	`, model, model))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return a, err
+}
+
+// ListAliases returns all aliases ordered by name.
+func (db *DB) ListAliases() ([]Alias, error) {
+	rows, err := db.conn.Query(`SELECT ` + aliasColumns + ` FROM model_aliases ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var aliases []Alias
+	for rows.Next() {
+		a, err := scanAlias(rows)
+		if err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, *a)
+	}
+	return aliases, rows.Err()
+}
+
+// DeleteAlias removes an alias.
+func (db *DB) DeleteAlias(id int) error {
+	result, err := db.conn.Exec(`DELETE FROM model_aliases WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// --- HTTP handlers ---
+
+// handleListAliases handles GET /api/admin/aliases
+func handleListAliases(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		aliases, err := db.ListAliases()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list aliases"})
+			return
+		}
+		if aliases == nil {
+			aliases = []Alias{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"aliases": aliases})
+	}
+}
+
+// handleCreateAlias handles POST /api/admin/aliases
+func handleCreateAlias(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var a Alias
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := a.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if err := a.checkChaining(db); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := db.CreateAlias(&a); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("failed to create alias: %v", err)})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"alias": a})
+	}
+}
+
+// handleUpdateAlias handles PUT /api/admin/aliases/{id}
+func handleUpdateAlias(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid alias ID"})
+			return
+		}
+
+		var a Alias
+		if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := a.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		a.ID = id
+		if err := a.checkChaining(db); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := db.UpdateAlias(&a); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "alias not found"})
+				return
+			}
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("failed to update alias: %v", err)})
+			return
+		}
+		updated, err := db.GetAlias(a.Name)
+		if err != nil || updated == nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "alias updated but could not be reloaded"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"alias": updated})
+	}
+}
+
+// handleDeleteAlias handles DELETE /api/admin/aliases/{id}
+func handleDeleteAlias(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid alias ID"})
+			return
+		}
+
+		if err := db.DeleteAlias(id); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "alias not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete alias"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
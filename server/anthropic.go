@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Anthropic Messages API compatible types (POST /v1/messages).
+// These match what the anthropic SDKs and tools built on them send and expect.
+
+type anthropicRequest struct {
+	Model         string             `json:"model"`
+	MaxTokens     *int               `json:"max_tokens,omitempty"`
+	System        json.RawMessage    `json:"system,omitempty"` // string or array of text blocks
+	Messages      []anthropicMessage `json:"messages"`
+	Stream        bool               `json:"stream"`
+	Temperature   *float64           `json:"temperature,omitempty"`
+	TopP          *float64           `json:"top_p,omitempty"`
+	TopK          *int               `json:"top_k,omitempty"`
+	StopSequences []string           `json:"stop_sequences,omitempty"`
+	Tools         []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice    *struct {
+		Type string `json:"type"` // "auto", "any", "tool", "none"
+		Name string `json:"name,omitempty"`
+	} `json:"tool_choice,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"` // string or array of content blocks
+}
+
+type anthropicBlock struct {
+	Type string `json:"type"`
+
+	// text
+	Text string `json:"text,omitempty"`
+
+	// image
+	Source *struct {
+		Type      string `json:"type"` // "base64" (or "url", which we reject)
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+	} `json:"source,omitempty"`
+
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+
+	// tool_result
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	Content   json.RawMessage `json:"content,omitempty"`
+}
+
+type anthropicTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	InputSchema json.RawMessage `json:"input_schema"`
+}
+
+type anthropicResponse struct {
+	ID           string           `json:"id"`
+	Type         string           `json:"type"`
+	Role         string           `json:"role"`
+	Model        string           `json:"model"`
+	Content      []anthropicBlock `json:"content"`
+	StopReason   *string          `json:"stop_reason"`
+	StopSequence *string          `json:"stop_sequence"`
+	Usage        anthropicUsage   `json:"usage"`
+}
+
+type anthropicUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+func generateMessageID() string {
+	b, _ := randomHex(12)
+	return "msg_" + b
+}
+
+// handleAnthropicMessages handles POST /v1/messages
+func handleAnthropicMessages(db *DB, backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req anthropicRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "Could not parse request body.")
+			return
+		}
+		if req.Model == "" {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "model: Field required")
+			return
+		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeAnthropicError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("Your API key does not have access to model: %s", req.Model))
+			return
+		}
+		if len(req.Messages) == 0 {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "messages: Field required")
+			return
+		}
+
+		chatReq, err := buildAnthropicChatRequest(&req)
+		if err != nil {
+			writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		targets, err := resolveChatTargets(r.Context(), db, req.Model)
+		if err != nil {
+			writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Failed to resolve model.")
+			return
+		}
+		if len(targets) == 0 {
+			writeAnthropicError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("Your API key does not have access to model: %s", req.Model))
+			return
+		}
+
+		ticket, err := inferenceQueue.EnqueueRequest(r)
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeAnthropicError(w, http.StatusServiceUnavailable, "overloaded_error", "Server is busy: "+err.Error()+".")
+			return
+		}
+		defer ticket.Release()
+
+		id := generateMessageID()
+		var usage anthropicUsage
+		var start time.Time
+		if req.Stream {
+			start = time.Now()
+			usage, err = handleAnthropicStream(r.Context(), w, backend, ticket, targets, chatReq, &req, id)
+		} else {
+			if err := ticket.Wait(nil); err != nil {
+				writeQueueRetryAfter(w)
+				writeAnthropicError(w, http.StatusServiceUnavailable, "overloaded_error", "Server is busy: "+err.Error()+".")
+				return
+			}
+			start = time.Now()
+			usage, err = handleAnthropicNonStream(r.Context(), w, backend, targets, chatReq, &req, id)
+		}
+		if isQueueError(err) {
+			return
+		}
+		recordUsage(db, r, req.Model, start, usage.InputTokens, usage.OutputTokens, err)
+	}
+}
+
+func handleAnthropicNonStream(ctx context.Context, w http.ResponseWriter, backend Backend, targets chatTargets, chatReq ChatRequest, req *anthropicRequest, id string) (anthropicUsage, error) {
+	resp, served, err := targets.Chat(ctx, backend, chatReq)
+	req.Model = served
+	if err != nil {
+		log.Printf("Inference error: %v", err)
+		writeAnthropicError(w, http.StatusBadGateway, "api_error", fmt.Sprintf("Model inference failed: %v", err))
+		return anthropicUsage{}, err
+	}
+
+	content := []anthropicBlock{}
+	if resp.Message.Content != "" {
+		content = append(content, anthropicBlock{Type: "text", Text: resp.Message.Content})
+	}
+	for _, tc := range toOpenAIToolCalls(resp.Message.ToolCalls) {
+		content = append(content, anthropicBlock{
+			Type:  "tool_use",
+			ID:    anthropicToolUseID(tc.ID),
+			Name:  tc.Function.Name,
+			Input: json.RawMessage(tc.Function.Arguments),
+		})
+	}
+
+	usage := anthropicUsage{InputTokens: resp.PromptTokens, OutputTokens: resp.CompletionTokens}
+	stopReason := anthropicStopReason(resp.DoneReason, len(resp.Message.ToolCalls) > 0)
+	writeJSON(w, http.StatusOK, anthropicResponse{
+		ID:         id,
+		Type:       "message",
+		Role:       "assistant",
+		Model:      req.Model,
+		Content:    content,
+		StopReason: &stopReason,
+		Usage:      usage,
+	})
+	return usage, nil
+}
+
+func handleAnthropicStream(ctx context.Context, w http.ResponseWriter, backend Backend, ticket *queueTicket, targets chatTargets, chatReq ChatRequest, req *anthropicRequest, id string) (anthropicUsage, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", "Streaming not supported.")
+		return anthropicUsage{}, fmt.Errorf("streaming not supported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(event string, payload map[string]any) {
+		payload["type"] = event
+		data, _ := json.Marshal(payload)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		flusher.Flush()
+	}
+
+	// Queue position goes out as SSE comments, which Anthropic clients ignore
+	err := ticket.Wait(func(position int) {
+		fmt.Fprintf(w, ": queued %d\n\n", position)
+		flusher.Flush()
+	})
+	if err != nil {
+		send("error", map[string]any{
+			"error": map[string]any{"type": "overloaded_error", "message": "Server is busy: " + err.Error() + "."},
+		})
+		return anthropicUsage{}, err
+	}
+
+	// message_start waits for the model's first output so that it names the
+	// model a fallback chain settled on.
+	started := false
+	start := func() {
+		send("message_start", map[string]any{
+			"message": anthropicResponse{
+				ID:      id,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   req.Model,
+				Content: []anthropicBlock{},
+			},
+		})
+		send("ping", map[string]any{})
+		started = true
+	}
+
+	// Content blocks are numbered in the order they open. Text goes into one
+	// block that is opened lazily; each tool call gets a block of its own.
+	blockIndex := -1
+	textOpen := false
+	closeText := func() {
+		if textOpen {
+			send("content_block_stop", map[string]any{"index": blockIndex})
+			textOpen = false
+		}
+	}
+
+	var usage anthropicUsage
+	var doneReason string
+	sawToolCall := false
+	served, err := targets.ChatStream(ctx, backend, chatReq, func(model string, chunk StreamChunk) error {
+		if !started {
+			req.Model = model
+			start()
+		}
+		if chunk.Content != "" {
+			if !textOpen {
+				blockIndex++
+				textOpen = true
+				send("content_block_start", map[string]any{
+					"index":         blockIndex,
+					"content_block": map[string]any{"type": "text", "text": ""},
+				})
+			}
+			send("content_block_delta", map[string]any{
+				"index": blockIndex,
+				"delta": map[string]any{"type": "text_delta", "text": chunk.Content},
+			})
+		}
+
+		for _, tc := range toOpenAIToolCalls(chunk.ToolCalls) {
+			closeText()
+			sawToolCall = true
+			blockIndex++
+			send("content_block_start", map[string]any{
+				"index": blockIndex,
+				"content_block": map[string]any{
+					"type": "tool_use", "id": anthropicToolUseID(tc.ID), "name": tc.Function.Name, "input": map[string]any{},
+				},
+			})
+			send("content_block_delta", map[string]any{
+				"index": blockIndex,
+				"delta": map[string]any{"type": "input_json_delta", "partial_json": tc.Function.Arguments},
+			})
+			send("content_block_stop", map[string]any{"index": blockIndex})
+		}
+
+		if chunk.Done {
+			usage = anthropicUsage{InputTokens: chunk.PromptTokens, OutputTokens: chunk.CompletionTokens}
+			doneReason = chunk.DoneReason
+		}
+		return nil
+	})
+
+	req.Model = served
+	if err != nil {
+		log.Printf("Stream error: %v", err)
+		send("error", map[string]any{
+			"error": map[string]string{"type": "api_error", "message": fmt.Sprintf("Model inference failed: %v", err)},
+		})
+		return usage, err
+	}
+	if !started {
+		start()
+	}
+
+	closeText()
+	send("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": anthropicStopReason(doneReason, sawToolCall), "stop_sequence": nil},
+		"usage": map[string]int{"output_tokens": usage.OutputTokens},
+	})
+	send("message_stop", map[string]any{})
+	return usage, nil
+}
+
+// buildAnthropicChatRequest translates an Anthropic request into an Ollama chat call:
+// the top-level system prompt becomes a system message, content blocks are
+// flattened into text, images and tool calls, and tool results become "tool" messages.
+func buildAnthropicChatRequest(req *anthropicRequest) (ChatRequest, error) {
+	var messages []ChatMessage
+
+	if len(req.System) > 0 && string(req.System) != "null" {
+		system, _, err := flattenAnthropicContent(req.System)
+		if err != nil {
+			return ChatRequest{}, fmt.Errorf("system: %v", err)
+		}
+		if system.Content != "" {
+			messages = append(messages, ChatMessage{Role: "system", Content: system.Content})
+		}
+	}
+
+	toolNames := make(map[string]string)
+	for i, m := range req.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return ChatRequest{}, fmt.Errorf("messages.%d.role: must be 'user' or 'assistant'", i)
+		}
+		msg, results, err := flattenAnthropicContent(m.Content)
+		if err != nil {
+			return ChatRequest{}, fmt.Errorf("messages.%d.content: %v", i, err)
+		}
+		msg.Role = m.Role
+		for _, tc := range msg.ToolCalls {
+			toolNames[tc.ID] = tc.Function.Name
+		}
+
+		// Tool results travel in user turns; Ollama wants them as separate "tool" messages first.
+		for _, res := range results {
+			res.ToolName = toolNames[res.ToolCallID]
+			messages = append(messages, res)
+		}
+		if msg.Content != "" || len(msg.Images) > 0 || len(msg.ToolCalls) > 0 {
+			messages = append(messages, msg)
+		}
+	}
+
+	opts := make(map[string]any)
+	if req.MaxTokens != nil {
+		opts["num_predict"] = *req.MaxTokens
+	}
+	if req.Temperature != nil {
+		opts["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		opts["top_p"] = *req.TopP
+	}
+	if req.TopK != nil {
+		opts["top_k"] = *req.TopK
+	}
+	if len(req.StopSequences) > 0 {
+		opts["stop"] = req.StopSequences
+	}
+	if len(opts) == 0 {
+		opts = nil
+	}
+
+	var tools []Tool
+	for _, t := range req.Tools {
+		tools = append(tools, Tool{
+			Type:     "function",
+			Function: ToolFunction{Name: t.Name, Description: t.Description, Parameters: t.InputSchema},
+		})
+	}
+	if req.ToolChoice != nil {
+		switch req.ToolChoice.Type {
+		case "none":
+			tools = nil
+		case "tool":
+			tools = selectTools(tools, map[string]any{"function": map[string]any{"name": req.ToolChoice.Name}})
+		}
+	}
+
+	return ChatRequest{
+		Model:    req.Model,
+		Messages: toOllamaMessages(messages),
+		Options:  opts,
+		Tools:    tools,
+	}, nil
+}
+
+// flattenAnthropicContent converts a string or block array into one message,
+// plus any tool_result blocks as separate "tool" messages.
+func flattenAnthropicContent(raw json.RawMessage) (ChatMessage, []ChatMessage, error) {
+	var msg ChatMessage
+	if len(raw) == 0 || string(raw) == "null" {
+		return msg, nil, nil
+	}
+
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		msg.Content = text
+		return msg, nil, nil
+	}
+
+	var blocks []anthropicBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return msg, nil, errors.New("must be a string or an array of content blocks")
+	}
+
+	var texts []string
+	var results []ChatMessage
+	for i, b := range blocks {
+		switch b.Type {
+		case "text":
+			texts = append(texts, b.Text)
+		case "image":
+			if b.Source == nil || b.Source.Type != "base64" {
+				return msg, nil, fmt.Errorf("%d: only base64 image sources are supported; remote image URLs are not fetched", i)
+			}
+			data, err := decodeImageData(b.Source.Data)
+			if err != nil {
+				return msg, nil, fmt.Errorf("%d: %v", i, err)
+			}
+			msg.Images = append(msg.Images, data)
+		case "tool_use":
+			input := b.Input
+			if len(input) == 0 {
+				input = json.RawMessage("{}")
+			}
+			msg.ToolCalls = append(msg.ToolCalls, ToolCall{
+				ID:       b.ID,
+				Type:     "function",
+				Function: ToolCallFunction{Name: b.Name, Arguments: input},
+			})
+		case "tool_result":
+			result, _, err := flattenAnthropicContent(b.Content)
+			if err != nil {
+				return msg, nil, fmt.Errorf("%d: %v", i, err)
+			}
+			results = append(results, ChatMessage{Role: "tool", Content: result.Content, ToolCallID: b.ToolUseID})
+		case "thinking", "redacted_thinking":
+			// Extended-thinking blocks from earlier turns carry nothing Ollama can use
+		default:
+			return msg, nil, fmt.Errorf("%d: unsupported content block type %q", i, b.Type)
+		}
+	}
+	msg.Content = strings.Join(texts, "\n")
+	return msg, results, nil
+}
+
+// anthropicStopReason maps Ollama's done_reason onto Anthropic's stop_reason.
+func anthropicStopReason(doneReason string, toolUse bool) string {
+	switch {
+	case toolUse:
+		return "tool_use"
+	case doneReason == "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicToolUseID gives tool calls the "toolu_" prefix Anthropic clients expect.
+func anthropicToolUseID(id string) string {
+	return "toolu_" + strings.TrimPrefix(id, "call_")
+}
+
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	writeJSON(w, status, map[string]any{
+		"type": "error",
+		"error": map[string]any{
+			"type":    errType,
+			"message": message,
+		},
+	})
+}
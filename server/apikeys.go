@@ -9,26 +9,185 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 // APIKey represents a row from the api_keys table (never includes the raw key).
 type APIKey struct {
-	ID        int        `json:"id"`
-	KeyPrefix string     `json:"key_prefix"`
-	UserID    int        `json:"user_id"`
-	Name      string     `json:"name"`
-	RateLimit int        `json:"rate_limit"`
-	LastUsed  *time.Time `json:"last_used_at,omitempty"`
-	CreatedAt time.Time  `json:"created_at"`
+	ID           int          `json:"id"`
+	KeyPrefix    string       `json:"key_prefix"`
+	UserID       int          `json:"user_id"`
+	Name         string       `json:"name"`
+	RateLimit    int          `json:"rate_limit"` // requests per minute, 0 = unlimited
+	RequestCount int          `json:"request_count"`
+	LastUsed     *time.Time   `json:"last_used_at,omitempty"`
+	ModelPolicy  *ModelPolicy `json:"model_policy,omitempty"`
+	APIKeyRestrictions
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKeyRestrictions limit until when, for what and from where a key may be
+// used. The zero value restricts nothing.
+type APIKeyRestrictions struct {
+	ExpiresAt    *time.Time `json:"expires_at,omitempty"`
+	Scopes       []string   `json:"scopes,omitempty"`        // empty = every scope
+	AllowedCIDRs []string   `json:"allowed_cidrs,omitempty"` // empty = any address
+}
+
+const apiKeyContextKey contextKey = "api_key"
+
+// API key scopes. A key with no scopes may call everything its owner can.
+const (
+	scopeChat        = "chat"         // chat and text completions, Anthropic messages
+	scopeEmbeddings  = "embeddings"   // embeddings
+	scopeModelsRead  = "models:read"  // listing and inspecting models
+	scopeModelsWrite = "models:write" // pulling, creating and deleting models through the Ollama proxy
+)
+
+var apiKeyScopes = []string{scopeChat, scopeEmbeddings, scopeModelsRead, scopeModelsWrite}
+
+// apiKeyRouteScopes maps the paths served to API keys to the scope they need.
+var apiKeyRouteScopes = map[string]string{
+	"/v1/chat/completions":                scopeChat,
+	"/v1/messages":                        scopeChat,
+	"/v1/completions":                     scopeChat,
+	"/v1/embeddings":                      scopeEmbeddings,
+	"/v1/models":                          scopeModelsRead,
+	ollamaProxyPrefix + "/api/chat":       scopeChat,
+	ollamaProxyPrefix + "/api/generate":   scopeChat,
+	ollamaProxyPrefix + "/api/embed":      scopeEmbeddings,
+	ollamaProxyPrefix + "/api/embeddings": scopeEmbeddings,
+	ollamaProxyPrefix + "/api/tags":       scopeModelsRead,
+	ollamaProxyPrefix + "/api/show":       scopeModelsRead,
+	ollamaProxyPrefix + "/api/ps":         scopeModelsRead,
+}
+
+// scopeForPath returns the scope a request path needs, or "" if any key may call it.
+func scopeForPath(path string) string {
+	if scope, ok := apiKeyRouteScopes[path]; ok {
+		return scope
+	}
+	if rest, ok := strings.CutPrefix(path, ollamaProxyPrefix); ok {
+		for _, p := range ollamaAdminPaths {
+			if rest == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(rest, p)) {
+				return scopeModelsWrite
+			}
+		}
+	}
+	return ""
+}
+
+// normalize validates the restrictions and canonicalizes the CIDR list; a
+// bare address is taken as a single-host range.
+func (k *APIKeyRestrictions) normalize() error {
+	for _, scope := range k.Scopes {
+		if !slices.Contains(apiKeyScopes, scope) {
+			return fmt.Errorf("unknown scope %q (valid scopes: %s)", scope, strings.Join(apiKeyScopes, ", "))
+		}
+	}
+	for i, cidr := range k.AllowedCIDRs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			addr, aerr := netip.ParseAddr(strings.TrimSpace(cidr))
+			if aerr != nil {
+				return fmt.Errorf("invalid CIDR %q", cidr)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		k.AllowedCIDRs[i] = prefix.Masked().String()
+	}
+	return nil
+}
+
+func (k *APIKeyRestrictions) expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// hasScope reports whether the key may be used for scope ("" needs no scope).
+func (k *APIKeyRestrictions) hasScope(scope string) bool {
+	return scope == "" || len(k.Scopes) == 0 || slices.Contains(k.Scopes, scope)
+}
+
+// allowsAddr reports whether a request from addr may use the key.
+func (k *APIKeyRestrictions) allowsAddr(addr netip.Addr, ok bool) bool {
+	if len(k.AllowedCIDRs) == 0 {
+		return true
+	}
+	if !ok {
+		return false
+	}
+	for _, cidr := range k.AllowedCIDRs {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address a request came from. Forwarding headers
+// are only believed from a proxy on this machine (the cloudflared tunnel);
+// any other caller could set them to an address it wants to pass as.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr := peer.Addr().Unmap()
+	if !addr.IsLoopback() {
+		return addr, true
+	}
+
+	forwarded := r.Header.Get("Cf-Connecting-Ip")
+	if forwarded == "" {
+		// The proxy appends the address it saw; earlier entries come from the client
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			forwarded = xff[strings.LastIndex(xff, ",")+1:]
+		}
+	}
+	if forwarded == "" {
+		return addr, true
+	}
+	fwd, err := netip.ParseAddr(strings.TrimSpace(forwarded))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return fwd.Unmap(), true
+}
+
+// encodeStringList converts a list to its JSON column value (NULL when empty).
+func encodeStringList(list []string) any {
+	if len(list) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(list)
+	return string(b)
+}
+
+func decodeStringList(s sql.NullString) []string {
+	var list []string
+	if s.Valid && s.String != "" {
+		json.Unmarshal([]byte(s.String), &list)
+	}
+	return list
 }
 
 // --- Database methods ---
 
-// CreateAPIKey generates a new API key for a user.
+// CreateAPIKey generates a new API key for a user, optionally restricted to
+// some models, scopes and source addresses, and optionally expiring.
 // Returns the APIKey metadata and the raw key (shown once, never stored).
-func (db *DB) CreateAPIKey(userID int, name string) (*APIKey, string, error) {
+func (db *DB) CreateAPIKey(userID int, name string, policy *ModelPolicy, limits APIKeyRestrictions) (*APIKey, string, error) {
+	return insertAPIKey(db.conn, userID, name, 100, policy, limits)
+}
+
+func insertAPIKey(exec interface {
+	Exec(string, ...any) (sql.Result, error)
+}, userID int, name string, rateLimit int, policy *ModelPolicy, limits APIKeyRestrictions) (*APIKey, string, error) {
 	rawBytes := make([]byte, 36)
 	if _, err := rand.Read(rawBytes); err != nil {
 		return nil, "", fmt.Errorf("generating key: %w", err)
@@ -39,52 +198,95 @@ func (db *DB) CreateAPIKey(userID int, name string) (*APIKey, string, error) {
 	hash := sha256.Sum256([]byte(rawKey))
 	keyHash := hex.EncodeToString(hash[:])
 
-	result, err := db.conn.Exec(`
-		INSERT INTO api_keys (key_hash, key_prefix, user_id, name)
-		VALUES (?, ?, ?, ?)
-	`, keyHash, prefix, userID, name)
+	result, err := exec.Exec(`
+		INSERT INTO api_keys (key_hash, key_prefix, user_id, name, rate_limit, model_policy, expires_at, scopes, allowed_cidrs)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, keyHash, prefix, userID, name, rateLimit, encodeModelPolicy(policy),
+		limits.ExpiresAt, encodeStringList(limits.Scopes), encodeStringList(limits.AllowedCIDRs))
 	if err != nil {
 		return nil, "", fmt.Errorf("inserting api key: %w", err)
 	}
 
 	id, _ := result.LastInsertId()
 	return &APIKey{
-		ID:        int(id),
-		KeyPrefix: prefix,
-		UserID:    userID,
-		Name:      name,
-		RateLimit: 100,
+		ID:                 int(id),
+		KeyPrefix:          prefix,
+		UserID:             userID,
+		Name:               name,
+		RateLimit:          rateLimit,
+		ModelPolicy:        policy,
+		APIKeyRestrictions: limits,
+		CreatedAt:          time.Now().UTC(),
 	}, rawKey, nil
 }
 
-// ValidateAPIKey checks a raw API key. Returns the associated user if valid.
-func (db *DB) ValidateAPIKey(rawKey string) (*User, error) {
+const apiKeyColumns = `id, key_prefix, user_id, name, rate_limit, request_count, last_used_at, model_policy, expires_at, scopes, allowed_cidrs, created_at`
+
+func scanAPIKey(row interface{ Scan(...any) error }) (*APIKey, error) {
+	var k APIKey
+	var policy, scopes, cidrs sql.NullString
+	if err := row.Scan(&k.ID, &k.KeyPrefix, &k.UserID, &k.Name, &k.RateLimit, &k.RequestCount, &k.LastUsed,
+		&policy, &k.ExpiresAt, &scopes, &cidrs, &k.CreatedAt); err != nil {
+		return nil, err
+	}
+	k.ModelPolicy = decodeModelPolicy(policy)
+	k.Scopes = decodeStringList(scopes)
+	k.AllowedCIDRs = decodeStringList(cidrs)
+	return &k, nil
+}
+
+// GetAPIKey returns a key's metadata, or sql.ErrNoRows.
+func (db *DB) GetAPIKey(id int) (*APIKey, error) {
+	return scanAPIKey(db.conn.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE id = ?`, id))
+}
+
+// AuthenticateAPIKey looks up a raw API key without recording any usage or
+// checking its restrictions (expiry included; see requireAPIKey).
+// Returns the owning user and the key metadata, or nils if the key is unknown.
+func (db *DB) AuthenticateAPIKey(rawKey string) (*User, *APIKey, error) {
 	hash := sha256.Sum256([]byte(rawKey))
 	keyHash := hex.EncodeToString(hash[:])
 
-	var userID int
-	err := db.conn.QueryRow(`
-		SELECT user_id FROM api_keys WHERE key_hash = ?
-	`, keyHash).Scan(&userID)
+	k, err := scanAPIKey(db.conn.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE key_hash = ?`, keyHash))
 	if err == sql.ErrNoRows {
-		return nil, nil
+		return nil, nil, nil
 	}
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	user, err := db.GetUserByID(k.UserID)
+	if err != nil || user == nil {
+		return nil, nil, err
 	}
+	return user, k, nil
+}
 
-	// Update last_used timestamp
-	db.conn.Exec(`UPDATE api_keys SET last_used_at = CURRENT_TIMESTAMP WHERE key_hash = ?`, keyHash)
+// RecordAPIKeyRequest bumps the request counter and last-used timestamp of a key.
+func (db *DB) RecordAPIKeyRequest(id int) error {
+	_, err := db.conn.Exec(`
+		UPDATE api_keys SET request_count = request_count + 1, last_used_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, id)
+	return err
+}
 
-	return db.GetUserByID(userID)
+// SetAPIKeyRateLimit changes the requests-per-minute limit of a key (0 = unlimited).
+func (db *DB) SetAPIKeyRateLimit(id, limit int) error {
+	result, err := db.conn.Exec(`UPDATE api_keys SET rate_limit = ? WHERE id = ?`, limit, id)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
 }
 
 // ListAPIKeys returns all API keys for admin view.
 func (db *DB) ListAPIKeys() ([]APIKey, error) {
-	rows, err := db.conn.Query(`
-		SELECT id, key_prefix, user_id, name, rate_limit, last_used_at, created_at
-		FROM api_keys ORDER BY created_at DESC
-	`)
+	rows, err := db.conn.Query(`SELECT ` + apiKeyColumns + ` FROM api_keys ORDER BY created_at DESC`)
 	if err != nil {
 		return nil, err
 	}
@@ -92,15 +294,56 @@ func (db *DB) ListAPIKeys() ([]APIKey, error) {
 
 	var keys []APIKey
 	for rows.Next() {
-		var k APIKey
-		if err := rows.Scan(&k.ID, &k.KeyPrefix, &k.UserID, &k.Name, &k.RateLimit, &k.LastUsed, &k.CreatedAt); err != nil {
+		k, err := scanAPIKey(rows)
+		if err != nil {
 			return nil, err
 		}
-		keys = append(keys, k)
+		keys = append(keys, *k)
 	}
 	return keys, rows.Err()
 }
 
+// RotateAPIKey issues a replacement for a key with the same owner, name,
+// rate limit, model policy, scopes and address ranges, and makes the old key
+// expire after grace (or sooner, if it already would). The replacement gets
+// expiresAt, if given, or else the old key's lifetime counted from now.
+// Returns sql.ErrNoRows if the key does not exist.
+func (db *DB) RotateAPIKey(id int, grace time.Duration, expiresAt *time.Time) (newKey *APIKey, rawKey string, oldExpiresAt time.Time, err error) {
+	old, err := db.GetAPIKey(id)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	limits := old.APIKeyRestrictions
+	if expiresAt == nil && old.ExpiresAt != nil {
+		t := now.Add(old.ExpiresAt.Sub(old.CreatedAt))
+		expiresAt = &t
+	}
+	limits.ExpiresAt = expiresAt
+	oldExpiresAt = now.Add(grace)
+	if old.ExpiresAt != nil && old.ExpiresAt.Before(oldExpiresAt) {
+		oldExpiresAt = *old.ExpiresAt
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	defer tx.Rollback()
+	newKey, rawKey, err = insertAPIKey(tx, old.UserID, old.Name, old.RateLimit, old.ModelPolicy, limits)
+	if err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if _, err := tx.Exec(`UPDATE api_keys SET expires_at = ? WHERE id = ?`, oldExpiresAt, id); err != nil {
+		return nil, "", time.Time{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, "", time.Time{}, err
+	}
+	return newKey, rawKey, oldExpiresAt, nil
+}
+
 // DeleteAPIKey revokes an API key.
 func (db *DB) DeleteAPIKey(id int) error {
 	_, err := db.conn.Exec(`DELETE FROM api_keys WHERE id = ?`, id)
@@ -113,14 +356,36 @@ func handleCreateAPIKey(db *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := UserFromContext(r.Context())
 		var req struct {
-			Name string `json:"name"`
+			Name         string       `json:"name"`
+			ModelPolicy  *ModelPolicy `json:"model_policy"`
+			ExpiresIn    string       `json:"expires_in"` // e.g. "24h", "90d", "" for never
+			Scopes       []string     `json:"scopes"`
+			AllowedCIDRs []string     `json:"allowed_cidrs"`
 		}
 		json.NewDecoder(r.Body).Decode(&req)
 		if req.Name == "" {
 			req.Name = "default"
 		}
+		if req.ModelPolicy != nil {
+			if err := req.ModelPolicy.validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
+		limits := APIKeyRestrictions{Scopes: req.Scopes, AllowedCIDRs: req.AllowedCIDRs}
+		if err := limits.normalize(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		if req.ExpiresIn != "" {
+			expiresAt, ok := parseExpiresIn(w, req.ExpiresIn)
+			if !ok {
+				return
+			}
+			limits.ExpiresAt = expiresAt
+		}
 
-		key, rawKey, err := db.CreateAPIKey(user.ID, req.Name)
+		key, rawKey, err := db.CreateAPIKey(user.ID, req.Name, req.ModelPolicy, limits)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to create key: %v", err)})
 			return
@@ -163,21 +428,194 @@ func handleDeleteAPIKey(db *DB) http.HandlerFunc {
 	}
 }
 
+// parseExpiresIn turns an expires_in value into an expiry time, writing a
+// 400 response if it is malformed.
+func parseExpiresIn(w http.ResponseWriter, s string) (*time.Time, bool) {
+	d, err := parseDuration(s)
+	if err != nil || d <= 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid expires_in format (use '24h', '90d', etc.)"})
+		return nil, false
+	}
+	t := time.Now().UTC().Add(d)
+	return &t, true
+}
+
+// defaultRotationGrace is how long a rotated key keeps working unless the
+// request says otherwise; maxRotationGrace caps it.
+const (
+	defaultRotationGrace = time.Hour
+	maxRotationGrace     = 7 * 24 * time.Hour
+)
+
+// handleRotateAPIKey handles POST /api/admin/api-keys/{id}/rotate: it issues
+// a replacement key and lets the old one keep working for a grace period so
+// clients can be switched over.
+func handleRotateAPIKey(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid key ID"})
+			return
+		}
+
+		var req struct {
+			GracePeriod string `json:"grace_period"` // e.g. "30m", "24h"; default 1h, "0m" revokes immediately
+			ExpiresIn   string `json:"expires_in"`   // for the new key; default: the old key's lifetime
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+
+		grace := defaultRotationGrace
+		if req.GracePeriod != "" {
+			d, err := parseDuration(req.GracePeriod)
+			if err != nil || d < 0 || d > maxRotationGrace {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid grace_period (use '30m', '24h', etc., at most 7d)"})
+				return
+			}
+			grace = d
+		}
+		var expiresAt *time.Time
+		if req.ExpiresIn != "" {
+			var ok bool
+			if expiresAt, ok = parseExpiresIn(w, req.ExpiresIn); !ok {
+				return
+			}
+		}
+
+		key, rawKey, oldExpiresAt, err := db.RotateAPIKey(id, grace, expiresAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to rotate key: %v", err)})
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, map[string]any{
+			"key":                     key,
+			"api_key":                 rawKey,
+			"previous_key_id":         id,
+			"previous_key_expires_at": oldExpiresAt,
+			"warning":                 "Save this key now. It won't be shown again.",
+		})
+	}
+}
+
+func handleSetAPIKeyRateLimit(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid key ID"})
+			return
+		}
+
+		var req struct {
+			RateLimit *int `json:"rate_limit"` // requests per minute, 0 = unlimited
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RateLimit == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "rate_limit is required"})
+			return
+		}
+		if *req.RateLimit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "rate_limit must be 0 (unlimited) or positive"})
+			return
+		}
+
+		if err := db.SetAPIKeyRateLimit(id, *req.RateLimit); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update rate limit"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "rate_limit": *req.RateLimit})
+	}
+}
+
+// --- Per-key rate limiter ---
+
+// apiKeyLimiter tracks recent request times per API key for the sliding-window limit.
+var apiKeyLimiter = newSlidingWindowLimiter(time.Minute)
+
+// slidingWindowLimiter allows at most N events per key within any window-long interval.
+type slidingWindowLimiter struct {
+	mu     sync.Mutex
+	window time.Duration
+	hits   map[int][]time.Time
+	swept  time.Time // when keys with no recent events were last dropped
+}
+
+func newSlidingWindowLimiter(window time.Duration) *slidingWindowLimiter {
+	return &slidingWindowLimiter{window: window, hits: make(map[int][]time.Time)}
+}
+
+// Allow records an event for key if fewer than limit events happened in the
+// current window. It returns whether the event was allowed, how many events
+// remain in the window, and how long until the oldest event falls out of it.
+func (l *slidingWindowLimiter) Allow(key, limit int, now time.Time) (allowed bool, remaining int, reset time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-l.window)
+	if now.Sub(l.swept) >= l.window {
+		// Forget keys that have gone idle (or were revoked) so the map doesn't grow forever
+		for k, h := range l.hits {
+			if len(h) == 0 || !h[len(h)-1].After(cutoff) {
+				delete(l.hits, k)
+			}
+		}
+		l.swept = now
+	}
+	hits := l.hits[key]
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	hits = hits[i:]
+
+	if len(hits) >= limit {
+		l.hits[key] = hits
+		return false, 0, hits[0].Sub(cutoff)
+	}
+
+	hits = append(hits, now)
+	l.hits[key] = hits
+	return true, limit - len(hits), hits[0].Sub(cutoff)
+}
+
+// Reset forgets all recorded events.
+func (l *slidingWindowLimiter) Reset() {
+	l.mu.Lock()
+	l.hits = make(map[int][]time.Time)
+	l.mu.Unlock()
+}
+
+// formatResetDuration renders a reset interval the way OpenAI does ("1s", "6m0s"), rounded up to whole seconds.
+func formatResetDuration(d time.Duration) string {
+	secs := (d + time.Second - 1) / time.Second
+	if secs < 1 {
+		secs = 1
+	}
+	return (secs * time.Second).String()
+}
+
 // --- API key auth middleware ---
 
-// requireAPIKey authenticates via the Authorization: Bearer header.
+// requireAPIKey authenticates via the Authorization: Bearer header (or the
+// x-api-key header Anthropic clients send) and enforces the key's expiry,
+// address ranges, scopes, model policy and per-minute request limit.
 func requireAPIKey(db *DB, next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if !strings.HasPrefix(auth, "Bearer ") {
+		rawKey := apiKeyFromRequest(r)
+		if rawKey == "" {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
 			fmt.Fprint(w, `{"error":{"message":"Missing API key. Include 'Authorization: Bearer sk-...' header.","type":"invalid_request_error","code":"missing_api_key"}}`)
 			return
 		}
 
-		rawKey := strings.TrimPrefix(auth, "Bearer ")
-		user, err := db.ValidateAPIKey(rawKey)
+		user, key, err := db.AuthenticateAPIKey(rawKey)
 		if err != nil || user == nil {
 			w.Header().Set("Content-Type", "application/json")
 			w.WriteHeader(http.StatusUnauthorized)
@@ -185,7 +623,80 @@ func requireAPIKey(db *DB, next http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
+		if key.expired(time.Now()) {
+			writeAPIKeyError(w, http.StatusUnauthorized, "expired_api_key", fmt.Sprintf("API key %s has expired.", key.KeyPrefix))
+			return
+		}
+		if !key.allowsAddr(clientAddr(r)) {
+			writeAPIKeyError(w, http.StatusForbidden, "ip_not_allowed", fmt.Sprintf("API key %s may not be used from this address.", key.KeyPrefix))
+			return
+		}
+		if scope := scopeForPath(r.URL.Path); !key.hasScope(scope) {
+			writeAPIKeyError(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("API key %s is missing the %q scope.", key.KeyPrefix, scope))
+			return
+		}
+		// Handlers check the model again against the owner's policy; checking
+		// the key's here keeps a restricted key from reaching them at all.
+		// Blob uploads carry no model and may be large, so they aren't read.
+		if !key.ModelPolicy.isEmpty() && r.Method == http.MethodPost && !strings.Contains(r.URL.Path, "/api/blobs/") {
+			if model := peekModel(r); model != "" && !key.ModelPolicy.Permits(model) {
+				writeAPIKeyError(w, http.StatusNotFound, "model_not_found", fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", model))
+				return
+			}
+		}
+
+		if key.RateLimit > 0 {
+			allowed, remaining, reset := apiKeyLimiter.Allow(key.ID, key.RateLimit, time.Now())
+			w.Header().Set("x-ratelimit-limit-requests", strconv.Itoa(key.RateLimit))
+			w.Header().Set("x-ratelimit-remaining-requests", strconv.Itoa(remaining))
+			w.Header().Set("x-ratelimit-reset-requests", formatResetDuration(reset))
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int((reset+time.Second-1)/time.Second)))
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusTooManyRequests)
+				json.NewEncoder(w).Encode(map[string]any{
+					"error": map[string]any{
+						"message": fmt.Sprintf("Rate limit reached for API key %s: limit %d requests per minute. Please try again in %s.", key.KeyPrefix, key.RateLimit, formatResetDuration(reset)),
+						"type":    "requests",
+						"code":    "rate_limit_exceeded",
+					},
+				})
+				return
+			}
+		}
+
+		db.RecordAPIKeyRequest(key.ID)
+
 		ctx := context.WithValue(r.Context(), userContextKey, user)
+		ctx = context.WithValue(ctx, apiKeyContextKey, key)
 		next(w, r.WithContext(ctx))
 	}
 }
+
+// writeAPIKeyError writes an OpenAI-style error with a code, as the
+// middleware's other rejections are.
+func writeAPIKeyError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    "invalid_request_error",
+			"code":    code,
+		},
+	})
+}
+
+// apiKeyFromRequest extracts the raw key from the Authorization or x-api-key header.
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return r.Header.Get("x-api-key")
+}
+
+// APIKeyFromContext returns the API key used to authenticate the request, if any.
+func APIKeyFromContext(ctx context.Context) *APIKey {
+	key, _ := ctx.Value(apiKeyContextKey).(*APIKey)
+	return key
+}
@@ -18,13 +18,18 @@ import (
 
 // User represents a row from the users table.
 type User struct {
-	ID                  int       `json:"id"`
-	Username            string    `json:"username"`
-	DisplayName         string    `json:"display_name,omitempty"`
-	IsAdmin             bool      `json:"is_admin"`
-	EncryptionKey       []byte    `json:"-"`
-	Base64EncryptionKey string    `json:"encryption_key,omitempty"` // populated only on login/setup/register
-	CreatedAt           time.Time `json:"created_at"`
+	ID                  int          `json:"id"`
+	Username            string       `json:"username"`
+	DisplayName         string       `json:"display_name,omitempty"`
+	Email               string       `json:"email,omitempty"` // verified address SSO logins link by
+	IsAdmin             bool         `json:"is_admin"`
+	EncryptionKey       []byte       `json:"-"`
+	Base64EncryptionKey string       `json:"encryption_key,omitempty"` // populated only on login/setup/register
+	DailyTokenQuota     *int         `json:"daily_token_quota,omitempty"`
+	MonthlyTokenQuota   *int         `json:"monthly_token_quota,omitempty"`
+	ModelPolicy         *ModelPolicy `json:"model_policy,omitempty"`
+	TwoFactorEnabled    bool         `json:"two_factor_enabled"`
+	CreatedAt           time.Time    `json:"created_at"`
 }
 
 type contextKey string
@@ -65,11 +70,11 @@ func (db *DB) Authenticate(username, password string) (*User, error) {
 	var passwordHash string
 
 	err := db.conn.QueryRow(`
-		SELECT id, username, display_name, is_admin, encryption_key, created_at, password_hash
+		SELECT id, username, display_name, is_admin, encryption_key, totp_enabled, created_at, password_hash
 		FROM users WHERE username = ?
 	`, username).Scan(
 		&user.ID, &user.Username, &user.DisplayName,
-		&user.IsAdmin, &user.EncryptionKey, &user.CreatedAt, &passwordHash,
+		&user.IsAdmin, &user.EncryptionKey, &user.TwoFactorEnabled, &user.CreatedAt, &passwordHash,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -88,12 +93,13 @@ func (db *DB) Authenticate(username, password string) (*User, error) {
 // GetUserByID looks up a user by their ID.
 func (db *DB) GetUserByID(id int) (*User, error) {
 	var user User
+	var policy sql.NullString
 	err := db.conn.QueryRow(`
-		SELECT id, username, display_name, is_admin, encryption_key, created_at
+		SELECT id, username, display_name, is_admin, encryption_key, model_policy, totp_enabled, created_at
 		FROM users WHERE id = ?
 	`, id).Scan(
 		&user.ID, &user.Username, &user.DisplayName,
-		&user.IsAdmin, &user.EncryptionKey, &user.CreatedAt,
+		&user.IsAdmin, &user.EncryptionKey, &policy, &user.TwoFactorEnabled, &user.CreatedAt,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil
@@ -101,13 +107,14 @@ func (db *DB) GetUserByID(id int) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	user.ModelPolicy = decodeModelPolicy(policy)
 	return &user, nil
 }
 
 // ListUsers returns all registered users (for admin dashboard).
 func (db *DB) ListUsers() ([]User, error) {
 	rows, err := db.conn.Query(`
-		SELECT id, username, display_name, is_admin, created_at
+		SELECT id, username, display_name, COALESCE(email, ''), is_admin, daily_token_quota, monthly_token_quota, model_policy, totp_enabled, created_at
 		FROM users ORDER BY created_at DESC
 	`)
 	if err != nil {
@@ -118,9 +125,11 @@ func (db *DB) ListUsers() ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var u User
-		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.IsAdmin, &u.CreatedAt); err != nil {
+		var policy sql.NullString
+		if err := rows.Scan(&u.ID, &u.Username, &u.DisplayName, &u.Email, &u.IsAdmin, &u.DailyTokenQuota, &u.MonthlyTokenQuota, &policy, &u.TwoFactorEnabled, &u.CreatedAt); err != nil {
 			return nil, err
 		}
+		u.ModelPolicy = decodeModelPolicy(policy)
 		users = append(users, u)
 	}
 	return users, rows.Err()
@@ -134,8 +143,9 @@ func (db *DB) DeleteUser(id int) error {
 
 // --- Session management ---
 
-// CreateSession creates a new session for a user. Returns the session ID (cookie value).
-func (db *DB) CreateSession(userID int) (string, error) {
+// CreateSession creates a new session for a user, recording the client it
+// was created from. Returns the session ID (cookie value).
+func (db *DB) CreateSession(userID int, ip, userAgent string) (string, error) {
 	sessionID, err := randomHex(32)
 	if err != nil {
 		return "", fmt.Errorf("generating session ID: %w", err)
@@ -143,9 +153,9 @@ func (db *DB) CreateSession(userID int) (string, error) {
 
 	expiresAt := time.Now().Add(30 * 24 * time.Hour) // 30 days
 	_, err = db.conn.Exec(`
-		INSERT INTO sessions (id, user_id, expires_at)
-		VALUES (?, ?, ?)
-	`, sessionID, userID, expiresAt)
+		INSERT INTO sessions (id, user_id, expires_at, ip, user_agent)
+		VALUES (?, ?, ?, ?, ?)
+	`, sessionID, userID, expiresAt, ip, userAgent)
 	if err != nil {
 		return "", fmt.Errorf("inserting session: %w", err)
 	}
@@ -246,7 +256,7 @@ func handleSetup(db *DB) http.HandlerFunc {
 		db.SetConfig("server_name", req.ServerName)
 		db.SetConfig("setup_complete", "true")
 
-		sessionID, err := db.CreateSession(user.ID)
+		sessionID, err := db.CreateSession(user.ID, getIP(r), r.UserAgent())
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "account created but session failed"})
 			return
@@ -345,39 +355,57 @@ func handleLogin(db *DB) http.HandlerFunc {
 			return
 		}
 
-		resetRateLimit(ip)
-
-		sessionID, err := db.CreateSession(user.ID)
-		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create session"})
+		// With 2FA the password alone only earns a challenge for the second step
+		if user.TwoFactorEnabled {
+			challenge, err := db.CreateLoginChallenge(user.ID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"two_factor_required": true,
+				"challenge":           challenge,
+				"expires_in":          int(loginChallengeTTL.Seconds()),
+			})
 			return
 		}
 
-		setSessionCookie(w, r, sessionID)
-		writeJSON(w, http.StatusOK, map[string]any{
-			"user": map[string]any{
-				"id":             user.ID,
-				"username":       user.Username,
-				"is_admin":       user.IsAdmin,
-				"encryption_key": base64.StdEncoding.EncodeToString(user.EncryptionKey),
-			},
-		})
+		resetRateLimit(ip)
+		startSession(w, r, db, user)
 	}
 }
 
+// startSession logs the user in: it sets the session cookie and returns the
+// user with their encryption key.
+func startSession(w http.ResponseWriter, r *http.Request, db *DB, user *User) {
+	sessionID, err := db.CreateSession(user.ID, getIP(r), r.UserAgent())
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to create session"})
+		return
+	}
+
+	setSessionCookie(w, r, sessionID)
+	resp := map[string]any{
+		"user": map[string]any{
+			"id":             user.ID,
+			"username":       user.Username,
+			"is_admin":       user.IsAdmin,
+			"encryption_key": base64.StdEncoding.EncodeToString(user.EncryptionKey),
+		},
+	}
+	if user.IsAdmin && !user.TwoFactorEnabled && adminTwoFactorRequired(db) {
+		resp["two_factor_setup_required"] = true
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
 func handleLogout(db *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		cookie, err := r.Cookie("session")
 		if err == nil {
 			db.DeleteSession(cookie.Value)
 		}
-		http.SetCookie(w, &http.Cookie{
-			Name:     "session",
-			Value:    "",
-			Path:     "/",
-			MaxAge:   -1,
-			HttpOnly: true,
-		})
+		clearSessionCookie(w)
 		writeJSON(w, http.StatusOK, map[string]string{"status": "logged out"})
 	}
 }
@@ -463,7 +491,9 @@ func requireAuth(db *DB, next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// requireAdmin is middleware that checks the user is an admin.
+// requireAdmin is middleware that checks the user is an admin. When 2FA is
+// required for admins, an admin without it can only reach the enrollment
+// endpoints, which sit behind requireAuth.
 func requireAdmin(db *DB, next http.HandlerFunc) http.HandlerFunc {
 	return requireAuth(db, func(w http.ResponseWriter, r *http.Request) {
 		user := UserFromContext(r.Context())
@@ -471,6 +501,10 @@ func requireAdmin(db *DB, next http.HandlerFunc) http.HandlerFunc {
 			writeJSON(w, http.StatusForbidden, map[string]string{"error": "admin access required"})
 			return
 		}
+		if !user.TwoFactorEnabled && adminTwoFactorRequired(db) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "two-factor authentication must be enabled for admin accounts"})
+			return
+		}
 		next(w, r)
 	})
 }
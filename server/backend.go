@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Backend is the inference server Fireside fronts. OllamaClient is the
+// default implementation; OpenAIBackend fronts any OpenAI-compatible server
+// such as llama.cpp's llama-server or vLLM.
+//
+// Inference methods take the caller's context: cancelling it (the client
+// disconnected) aborts the upstream call.
+type Backend interface {
+	// String describes the upstream for logs, e.g. "ollama at http://localhost:11434".
+	String() string
+
+	ListModels() ([]Model, error)
+	ListRunningModels() ([]RunningModel, error)
+	Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error)
+	ChatStream(ctx context.Context, req ChatRequest, onChunk func(StreamChunk) error) error
+
+	// Model management. Backends that cannot manage models return errBackendUnsupported.
+	PullModelStream(ctx context.Context, name string, onLine func([]byte) error) error
+	DeleteModel(name string) error
+}
+
+// Embedder is implemented by backends that can compute embeddings.
+type Embedder interface {
+	Embed(ctx context.Context, model string, input []string, dimensions int) (*EmbedResponse, error)
+}
+
+// Generator is implemented by backends with a raw (non-chat) completion API.
+type Generator interface {
+	Generate(ctx context.Context, req GenerateRequest) (*GenerateResponse, error)
+	GenerateStream(ctx context.Context, req GenerateRequest, onChunk func(GenerateResponse) error) error
+}
+
+// ModelLoader is implemented by backends that can load a model into memory
+// ahead of use and control how long it stays there.
+type ModelLoader interface {
+	// LoadModel loads the model and keeps it resident for keepAlive, an
+	// Ollama keep-alive such as "10m", "-1" (forever) or "0" (unload now).
+	LoadModel(ctx context.Context, name, keepAlive string) error
+}
+
+var (
+	_ Backend     = (*OllamaClient)(nil)
+	_ Embedder    = (*OllamaClient)(nil)
+	_ Generator   = (*OllamaClient)(nil)
+	_ ModelLoader = (*OllamaClient)(nil)
+	_ Backend     = (*OpenAIBackend)(nil)
+	_ Embedder    = (*OpenAIBackend)(nil)
+	_ Backend     = (*UpstreamPool)(nil)
+	_ Embedder    = (*UpstreamPool)(nil)
+	_ Generator   = (*UpstreamPool)(nil)
+	_ ModelLoader = (*UpstreamPool)(nil)
+)
+
+var errBackendUnsupported = errors.New("not supported by the configured inference backend")
+
+// NewBackend builds the backend selected by the --backend flag. Several
+// Ollama URLs make an UpstreamPool; the caller starts its health probes.
+func NewBackend(kind string, ollamaURLs []string, upstreamURL, upstreamKey string) (Backend, error) {
+	switch kind {
+	case "", "ollama":
+		switch len(ollamaURLs) {
+		case 0:
+			return nil, fmt.Errorf("at least one --ollama-url is required")
+		case 1:
+			return NewOllamaClient(ollamaURLs[0]), nil
+		default:
+			return NewUpstreamPool(ollamaURLs), nil
+		}
+	case "openai":
+		if upstreamURL == "" {
+			return nil, fmt.Errorf("--upstream-url is required with --backend openai")
+		}
+		return NewOpenAIBackend(upstreamURL, upstreamKey), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q (want \"ollama\" or \"openai\")", kind)
+	}
+}
+
+func (c *OllamaClient) String() string {
+	return "ollama at " + c.BaseURL
+}
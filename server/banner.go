@@ -2,8 +2,6 @@ package main
 
 import (
 	"fmt"
-	"net/http"
-	"time"
 )
 
 // ANSI colours
@@ -19,11 +17,11 @@ const (
 
 // printStartupBanner displays a clean, branded startup message.
 // Internal details are only shown with --verbose.
-func printStartupBanner(db *DB, ollama *OllamaClient, port int, verbose bool, tunnelURL string) {
+func printStartupBanner(db *DB, backend Backend, port int, verbose bool, tunnelURL string) {
 	url := fmt.Sprintf("http://localhost:%d", port)
 
 	setupDone, _ := db.IsSetupComplete()
-	ollamaOK := checkOllamaHealth(ollama)
+	backendOK := checkBackendHealth(backend)
 
 	fmt.Println()
 	fmt.Printf("  %s╭──────────────────────────────╮%s\n", orange, nc)
@@ -54,7 +52,7 @@ func printStartupBanner(db *DB, ollama *OllamaClient, port int, verbose bool, tu
 
 	fmt.Println()
 
-	if ollamaOK {
+	if backendOK {
 		fmt.Printf("  %s✓%s AI engine\n", green, nc)
 	} else {
 		fmt.Printf("  %s✗%s AI engine\n", red, nc)
@@ -72,19 +70,14 @@ func printStartupBanner(db *DB, ollama *OllamaClient, port int, verbose bool, tu
 
 	if verbose {
 		fmt.Printf("  %s--- Debug ---%s\n", dim, nc)
-		fmt.Printf("  %sOllama: %s%s\n", dim, ollama.BaseURL, nc)
-		fmt.Printf("  %sPort:   %d%s\n", dim, port, nc)
+		fmt.Printf("  %sBackend: %s%s\n", dim, backend, nc)
+		fmt.Printf("  %sPort:    %d%s\n", dim, port, nc)
 		fmt.Println()
 	}
 }
 
-// checkOllamaHealth pings Ollama to see if it's reachable.
-func checkOllamaHealth(ollama *OllamaClient) bool {
-	client := &http.Client{Timeout: 2 * time.Second}
-	resp, err := client.Get(ollama.BaseURL + "/api/tags")
-	if err != nil {
-		return false
-	}
-	resp.Body.Close()
-	return resp.StatusCode == http.StatusOK
+// checkBackendHealth pings the inference backend to see if it's reachable.
+func checkBackendHealth(backend Backend) bool {
+	_, err := backend.ListModels()
+	return err == nil
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// OpenAI-compatible legacy /v1/completions, backed by Ollama's /api/generate.
+// Used by code-completion plugins for fill-in-the-middle (prompt + suffix).
+
+type openAICompletionRequest struct {
+	Model            string               `json:"model"`
+	Prompt           json.RawMessage      `json:"prompt"` // string or array of strings
+	Suffix           string               `json:"suffix,omitempty"`
+	Stream           bool                 `json:"stream"`
+	StreamOptions    *openAIStreamOptions `json:"stream_options,omitempty"`
+	MaxTokens        *int                 `json:"max_tokens,omitempty"`
+	Temperature      *float64             `json:"temperature,omitempty"`
+	TopP             *float64             `json:"top_p,omitempty"`
+	Stop             any                  `json:"stop,omitempty"`
+	FrequencyPenalty *float64             `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64             `json:"presence_penalty,omitempty"`
+}
+
+type openAICompletionResponse struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []openAICompletionChoice `json:"choices"`
+	Usage   *openAIUsage             `json:"usage,omitempty"`
+}
+
+type openAICompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
+
+// handleOpenAICompletions handles POST /v1/completions
+func handleOpenAICompletions(db *DB, backend Backend) http.HandlerFunc {
+	gen, supported := backend.(Generator)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !supported {
+			writeOpenAIError(w, http.StatusNotImplemented, "invalid_request_error", "Text completions are not supported by the configured inference backend.")
+			return
+		}
+
+		var req openAICompletionRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Could not parse request body.")
+			return
+		}
+		if req.Model == "" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Missing required parameter: 'model'.")
+			return
+		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", req.Model))
+			return
+		}
+		if msg, err := chatOnlyModel(db, req.Model); err != nil || msg != "" {
+			if err != nil {
+				writeOpenAIError(w, http.StatusInternalServerError, "server_error", "Failed to resolve model.")
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", msg)
+			return
+		}
+		prompts, err := parseCompletionPrompt(req.Prompt)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		// Sampling options are shared with chat completions
+		opts := buildOllamaOptions(&openAIRequest{
+			MaxTokens:        req.MaxTokens,
+			Temperature:      req.Temperature,
+			TopP:             req.TopP,
+			Stop:             req.Stop,
+			FrequencyPenalty: req.FrequencyPenalty,
+			PresencePenalty:  req.PresencePenalty,
+		})
+
+		ticket, err := inferenceQueue.EnqueueRequest(r)
+		if err == nil {
+			defer ticket.Release()
+			err = ticket.Wait(nil)
+		}
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Server is busy: "+err.Error()+".")
+			return
+		}
+
+		id := generateTextCompletionID()
+		created := time.Now().Unix()
+		start := time.Now()
+
+		var usage *openAIUsage
+		if req.Stream {
+			usage, err = streamCompletions(r.Context(), w, gen, &req, prompts, opts, id, created)
+		} else {
+			usage, err = completeAll(r.Context(), w, gen, &req, prompts, opts, id, created)
+		}
+		if usage == nil {
+			usage = newOpenAIUsage(0, 0)
+		}
+		recordUsage(db, r, req.Model, start, usage.PromptTokens, usage.CompletionTokens, err)
+	}
+}
+
+// completeAll runs each prompt in turn and writes one text_completion with a choice per prompt.
+func completeAll(ctx context.Context, w http.ResponseWriter, gen Generator, req *openAICompletionRequest, prompts []string, opts map[string]any, id string, created int64) (*openAIUsage, error) {
+	usage := newOpenAIUsage(0, 0)
+	choices := make([]openAICompletionChoice, 0, len(prompts))
+	for i, prompt := range prompts {
+		resp, err := gen.Generate(ctx, GenerateRequest{Model: req.Model, Prompt: prompt, Suffix: req.Suffix, Options: opts})
+		if err != nil {
+			log.Printf("Ollama error: %v", err)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("Model inference failed: %v", err))
+			return usage, err
+		}
+		finishReason := completionFinishReason(resp.DoneReason)
+		choices = append(choices, openAICompletionChoice{Text: resp.Response, Index: i, FinishReason: &finishReason})
+		usage = newOpenAIUsage(usage.PromptTokens+resp.PromptEvalCount, usage.CompletionTokens+resp.EvalCount)
+	}
+
+	writeJSON(w, http.StatusOK, openAICompletionResponse{
+		ID:      id,
+		Object:  "text_completion",
+		Created: created,
+		Model:   req.Model,
+		Choices: choices,
+		Usage:   usage,
+	})
+	return usage, nil
+}
+
+// streamCompletions streams each prompt's completion in turn; choice.index identifies the prompt.
+func streamCompletions(ctx context.Context, w http.ResponseWriter, gen Generator, req *openAICompletionRequest, prompts []string, opts map[string]any, id string, created int64) (*openAIUsage, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "Streaming not supported.")
+		return nil, fmt.Errorf("streaming not supported")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	send := func(v any) {
+		data, _ := json.Marshal(v)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	usage := newOpenAIUsage(0, 0)
+	for i, prompt := range prompts {
+		err := gen.GenerateStream(ctx, GenerateRequest{Model: req.Model, Prompt: prompt, Suffix: req.Suffix, Options: opts}, func(chunk GenerateResponse) error {
+			choice := openAICompletionChoice{Text: chunk.Response, Index: i}
+			if chunk.Done {
+				finishReason := completionFinishReason(chunk.DoneReason)
+				choice.FinishReason = &finishReason
+				usage = newOpenAIUsage(usage.PromptTokens+chunk.PromptEvalCount, usage.CompletionTokens+chunk.EvalCount)
+			}
+			send(openAICompletionResponse{
+				ID:      id,
+				Object:  "text_completion",
+				Created: created,
+				Model:   req.Model,
+				Choices: []openAICompletionChoice{choice},
+			})
+			return nil
+		})
+		if err != nil {
+			log.Printf("Stream error: %v", err)
+			return usage, err
+		}
+	}
+
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		send(openAICompletionResponse{
+			ID:      id,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openAICompletionChoice{},
+			Usage:   usage,
+		})
+	}
+
+	fmt.Fprint(w, "data: [DONE]\n\n")
+	flusher.Flush()
+	return usage, nil
+}
+
+// parseCompletionPrompt accepts a string or an array of strings.
+func parseCompletionPrompt(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, fmt.Errorf("Missing required parameter: 'prompt'.")
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return []string{single}, nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, fmt.Errorf("'prompt' must be a string or an array of strings; token arrays are not supported.")
+	}
+	if len(many) == 0 {
+		return nil, fmt.Errorf("'prompt' must not be empty.")
+	}
+	return many, nil
+}
+
+// completionFinishReason maps Ollama's done_reason onto OpenAI's finish_reason.
+func completionFinishReason(doneReason string) string {
+	if doneReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+func generateTextCompletionID() string {
+	b, _ := randomHex(12)
+	return "cmpl-" + b
+}
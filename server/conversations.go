@@ -3,6 +3,7 @@ package main
 import (
 	"database/sql"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"time"
 )
@@ -25,7 +26,11 @@ type Message struct {
 	Content        string    `json:"content"`
 	Encrypted      bool      `json:"encrypted,omitempty"`
 	IV             string    `json:"iv,omitempty"`
+	Images         []string  `json:"images,omitempty"`           // base64 images, when decrypted server-side
+	ImagesEnc      string    `json:"images_encrypted,omitempty"` // base64 ciphertext of the JSON image list
+	ImagesIV       string    `json:"images_iv,omitempty"`
 	TokenCount     *int      `json:"token_count,omitempty"`
+	Interrupted    bool      `json:"interrupted,omitempty"` // generation was cut off before it finished
 	CreatedAt      time.Time `json:"created_at"`
 }
 
@@ -114,24 +119,30 @@ func (db *DB) touchConversation(id int) {
 // AddMessage stores a message in a conversation.
 // Encrypts the content using the user's per-user AES-256 key before storing.
 func (db *DB) AddMessage(conversationID int, role, content string, tokenCount *int, encryptionKey []byte) (*Message, error) {
-	var ciphertext, iv []byte
-	var err error
+	return db.AddMessageWithImages(conversationID, role, content, nil, tokenCount, encryptionKey)
+}
+
+// AddMessageWithImages stores a message along with its image attachments.
+// The images are kept as one JSON list, encrypted with the same key as the content.
+func (db *DB) AddMessageWithImages(conversationID int, role, content string, images []string, tokenCount *int, encryptionKey []byte) (*Message, error) {
+	ciphertext, iv, err := sealMessageField(encryptionKey, []byte(content))
+	if err != nil {
+		return nil, err
+	}
 
-	if len(encryptionKey) == 32 {
-		ciphertext, iv, err = EncryptAESGCM(encryptionKey, []byte(content))
+	var imagesCipher, imagesIV []byte
+	if len(images) > 0 {
+		imagesJSON, _ := json.Marshal(images)
+		imagesCipher, imagesIV, err = sealMessageField(encryptionKey, imagesJSON)
 		if err != nil {
-			return nil, fmt.Errorf("encryption failed: %w", err)
+			return nil, err
 		}
-	} else {
-		// Fallback to plaintext if no valid key is provided (legacy behavior)
-		ciphertext = []byte(content)
-		iv = []byte("plaintext")
 	}
 
 	result, err := db.conn.Exec(`
-		INSERT INTO messages (conversation_id, role, content_encrypted, content_iv, token_count)
-		VALUES (?, ?, ?, ?, ?)
-	`, conversationID, role, ciphertext, iv, tokenCount)
+		INSERT INTO messages (conversation_id, role, content_encrypted, content_iv, images_encrypted, images_iv, token_count)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, conversationID, role, ciphertext, iv, imagesCipher, imagesIV, tokenCount)
 	if err != nil {
 		return nil, fmt.Errorf("inserting message: %w", err)
 	}
@@ -144,10 +155,31 @@ func (db *DB) AddMessage(conversationID int, role, content string, tokenCount *i
 		ConversationID: conversationID,
 		Role:           role,
 		Content:        content, // Return plaintext to caller
+		Images:         images,
 		TokenCount:     tokenCount,
 	}, nil
 }
 
+// MarkMessageInterrupted flags a message whose generation was cut off, e.g.
+// because the client disconnected mid-stream.
+func (db *DB) MarkMessageInterrupted(id int) error {
+	_, err := db.conn.Exec(`UPDATE messages SET interrupted = 1 WHERE id = ?`, id)
+	return err
+}
+
+// sealMessageField encrypts a message field with the user's key, falling back
+// to plaintext storage (legacy behavior) when no valid key is provided.
+func sealMessageField(encryptionKey, plaintext []byte) (ciphertext, iv []byte, err error) {
+	if len(encryptionKey) != 32 {
+		return plaintext, []byte("plaintext"), nil
+	}
+	ciphertext, iv, err = EncryptAESGCM(encryptionKey, plaintext)
+	if err != nil {
+		return nil, nil, fmt.Errorf("encryption failed: %w", err)
+	}
+	return ciphertext, iv, nil
+}
+
 // GetMessages returns all messages in a conversation, oldest first.
 // If decrypt is true, decrypts messages using the user's encryption key.
 // If decrypt is false, serves raw base64 cipher and IV strings for the client.
@@ -166,7 +198,7 @@ func (db *DB) GetMessages(conversationID, userID int, encryptionKey []byte, decr
 	}
 
 	rows, err := db.conn.Query(`
-		SELECT id, conversation_id, role, content_encrypted, content_iv, token_count, created_at
+		SELECT id, conversation_id, role, content_encrypted, content_iv, images_encrypted, images_iv, token_count, interrupted, created_at
 		FROM messages WHERE conversation_id = ?
 		ORDER BY created_at ASC
 	`, conversationID)
@@ -178,12 +210,26 @@ func (db *DB) GetMessages(conversationID, userID int, encryptionKey []byte, decr
 	var messages []Message
 	for rows.Next() {
 		var m Message
-		var contentBytes []byte
-		var ivBytes []byte
-		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &contentBytes, &ivBytes, &m.TokenCount, &m.CreatedAt); err != nil {
+		var contentBytes, ivBytes, imagesBytes, imagesIV []byte
+		if err := rows.Scan(&m.ID, &m.ConversationID, &m.Role, &contentBytes, &ivBytes, &imagesBytes, &imagesIV, &m.TokenCount, &m.Interrupted, &m.CreatedAt); err != nil {
 			return nil, err
 		}
 
+		if len(imagesBytes) > 0 {
+			if string(imagesIV) == "plaintext" {
+				json.Unmarshal(imagesBytes, &m.Images)
+			} else if decrypt {
+				if len(encryptionKey) == 32 {
+					if plaintext, err := DecryptAESGCM(encryptionKey, imagesIV, imagesBytes); err == nil {
+						json.Unmarshal(plaintext, &m.Images)
+					}
+				}
+			} else {
+				m.ImagesEnc = base64.StdEncoding.EncodeToString(imagesBytes)
+				m.ImagesIV = base64.StdEncoding.EncodeToString(imagesIV)
+			}
+		}
+
 		if string(ivBytes) == "plaintext" {
 			m.Content = string(contentBytes)
 		} else if decrypt {
@@ -59,15 +59,74 @@ func (db *DB) Close() error {
 	return db.conn.Close()
 }
 
-// migrate creates all tables if they don't exist.
+// migrate creates all tables if they don't exist, then adds any columns
+// introduced after a database was first created.
 func (db *DB) migrate() error {
 	_, err := db.conn.Exec(schema)
 	if err != nil {
 		return fmt.Errorf("executing schema: %w", err)
 	}
+	for _, m := range columnMigrations {
+		if err := db.ensureColumn(m.table, m.column, m.definition); err != nil {
+			return fmt.Errorf("adding %s.%s: %w", m.table, m.column, err)
+		}
+	}
 	return nil
 }
 
+// columnMigrations lists columns added to existing tables after the initial release.
+// New databases already get them from schema; older ones are upgraded in place.
+var columnMigrations = []struct {
+	table, column, definition string
+}{
+	{"users", "daily_token_quota", "INTEGER"},
+	{"users", "monthly_token_quota", "INTEGER"},
+	{"messages", "images_encrypted", "BLOB"},
+	{"messages", "images_iv", "BLOB"},
+	{"messages", "interrupted", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "model_policy", "TEXT"},
+	{"invite_links", "model_policy", "TEXT"},
+	{"api_keys", "model_policy", "TEXT"},
+	{"users", "totp_secret", "TEXT"},
+	{"users", "totp_enabled", "BOOLEAN NOT NULL DEFAULT FALSE"},
+	{"users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0"},
+	{"users", "email", "TEXT"},
+	{"users", "oidc_subject", "TEXT"},
+	{"sessions", "ip", "TEXT"},
+	{"sessions", "user_agent", "TEXT"},
+	{"api_keys", "expires_at", "DATETIME"},
+	{"api_keys", "scopes", "TEXT"},
+	{"api_keys", "allowed_cidrs", "TEXT"},
+}
+
+// ensureColumn adds a column to a table unless it already exists.
+func (db *DB) ensureColumn(table, column, definition string) error {
+	rows, err := db.conn.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.conn.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
 // IsSetupComplete checks if the initial setup has been done.
 func (db *DB) IsSetupComplete() (bool, error) {
 	var value string
@@ -114,6 +173,16 @@ func (db *DB) ResetServer() error {
 	defer tx.Rollback()
 
 	tables := []string{
+		"oidc_states",
+		"webauthn_challenges",
+		"passkeys",
+		"login_challenges",
+		"recovery_codes",
+		"model_jobs",
+		"model_settings",
+		"model_aliases",
+		"model_presets",
+		"usage_log",
 		"api_keys",
 		"messages",
 		"conversations",
@@ -147,6 +216,14 @@ CREATE TABLE IF NOT EXISTS users (
     is_admin BOOLEAN DEFAULT FALSE,
     encryption_key BLOB NOT NULL,
     invite_id INTEGER REFERENCES invite_links(id),
+    daily_token_quota INTEGER,
+    monthly_token_quota INTEGER,
+    model_policy TEXT,
+    totp_secret TEXT,
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step INTEGER NOT NULL DEFAULT 0,
+    email TEXT,
+    oidc_subject TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
@@ -156,7 +233,9 @@ CREATE TABLE IF NOT EXISTS sessions (
     user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
     expires_at DATETIME NOT NULL,
-    last_active DATETIME DEFAULT CURRENT_TIMESTAMP
+    last_active DATETIME DEFAULT CURRENT_TIMESTAMP,
+    ip TEXT,
+    user_agent TEXT
 );
 
 CREATE TABLE IF NOT EXISTS invite_links (
@@ -167,6 +246,7 @@ CREATE TABLE IF NOT EXISTS invite_links (
     max_uses INTEGER DEFAULT 1,
     uses INTEGER DEFAULT 0,
     expires_at DATETIME,
+    model_policy TEXT,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -185,7 +265,10 @@ CREATE TABLE IF NOT EXISTS messages (
     role TEXT NOT NULL CHECK (role IN ('user', 'assistant', 'system')),
     content_encrypted BLOB NOT NULL,
     content_iv BLOB NOT NULL,
+    images_encrypted BLOB,
+    images_iv BLOB,
     token_count INTEGER,
+    interrupted INTEGER NOT NULL DEFAULT 0,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
@@ -198,13 +281,114 @@ CREATE TABLE IF NOT EXISTS api_keys (
     rate_limit INTEGER DEFAULT 100,
     request_count INTEGER DEFAULT 0,
     last_used_at DATETIME,
+    model_policy TEXT,
+    expires_at DATETIME,
+    scopes TEXT,
+    allowed_cidrs TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS usage_log (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    api_key_id INTEGER REFERENCES api_keys(id) ON DELETE SET NULL,
+    source TEXT NOT NULL CHECK (source IN ('session', 'api_key')),
+    endpoint TEXT NOT NULL,
+    model TEXT NOT NULL,
+    prompt_tokens INTEGER DEFAULT 0,
+    completion_tokens INTEGER DEFAULT 0,
+    latency_ms INTEGER DEFAULT 0,
+    status TEXT NOT NULL CHECK (status IN ('ok', 'error')),
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS model_presets (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    base_model TEXT NOT NULL,
+    system_prompt TEXT,
+    temperature REAL,
+    num_ctx INTEGER,
+    examples TEXT,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS model_aliases (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT UNIQUE NOT NULL,
+    targets TEXT NOT NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS model_settings (
+    model TEXT PRIMARY KEY,
+    keep_alive TEXT,
+    pinned BOOLEAN NOT NULL DEFAULT FALSE,
+    updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS model_jobs (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    model TEXT NOT NULL,
+    status TEXT NOT NULL,
+    message TEXT,
+    completed INTEGER NOT NULL DEFAULT 0,
+    total INTEGER NOT NULL DEFAULT 0,
+    error TEXT,
+    created_by INTEGER REFERENCES users(id) ON DELETE SET NULL,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    started_at DATETIME,
+    finished_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at DATETIME,
     created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 );
 
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id TEXT PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS passkeys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    credential_id BLOB UNIQUE NOT NULL,
+    public_key BLOB NOT NULL,
+    sign_count INTEGER NOT NULL DEFAULT 0,
+    created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+    last_used_at DATETIME
+);
+
+CREATE TABLE IF NOT EXISTS webauthn_challenges (
+    challenge TEXT PRIMARY KEY,
+    user_id INTEGER REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS oidc_states (
+    state TEXT PRIMARY KEY,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    redirect_url TEXT NOT NULL,
+    expires_at DATETIME NOT NULL
+);
+
 CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
 CREATE INDEX IF NOT EXISTS idx_sessions_expires ON sessions(expires_at);
 CREATE INDEX IF NOT EXISTS idx_conversations_user ON conversations(user_id);
 CREATE INDEX IF NOT EXISTS idx_messages_conversation ON messages(conversation_id);
 CREATE INDEX IF NOT EXISTS idx_invite_links_token ON invite_links(token);
 CREATE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys(key_hash);
+CREATE INDEX IF NOT EXISTS idx_usage_log_user_created ON usage_log(user_id, created_at);
 `
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// OpenAI-compatible /v1/embeddings, backed by Ollama's /api/embed.
+
+type openAIEmbeddingRequest struct {
+	Model          string          `json:"model"`
+	Input          json.RawMessage `json:"input"`           // string or array of strings
+	EncodingFormat string          `json:"encoding_format"` // "float" (default) or "base64"
+	Dimensions     int             `json:"dimensions,omitempty"`
+}
+
+type openAIEmbeddingResponse struct {
+	Object string            `json:"object"`
+	Data   []openAIEmbedding `json:"data"`
+	Model  string            `json:"model"`
+	Usage  openAIEmbedUsage  `json:"usage"`
+}
+
+type openAIEmbedding struct {
+	Object    string `json:"object"`
+	Index     int    `json:"index"`
+	Embedding any    `json:"embedding"` // []float32, or a base64 string of little-endian float32s
+}
+
+type openAIEmbedUsage struct {
+	PromptTokens int `json:"prompt_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+// handleOpenAIEmbeddings handles POST /v1/embeddings
+func handleOpenAIEmbeddings(db *DB, backend Backend) http.HandlerFunc {
+	embedder, supported := backend.(Embedder)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !supported {
+			writeOpenAIError(w, http.StatusNotImplemented, "invalid_request_error", "Embeddings are not supported by the configured inference backend.")
+			return
+		}
+
+		var req openAIEmbeddingRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Could not parse request body.")
+			return
+		}
+		if req.Model == "" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Missing required parameter: 'model'.")
+			return
+		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", req.Model))
+			return
+		}
+		if msg, err := chatOnlyModel(db, req.Model); err != nil || msg != "" {
+			if err != nil {
+				writeOpenAIError(w, http.StatusInternalServerError, "server_error", "Failed to resolve model.")
+				return
+			}
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", msg)
+			return
+		}
+		if req.EncodingFormat != "" && req.EncodingFormat != "float" && req.EncodingFormat != "base64" {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "encoding_format must be 'float' or 'base64'.")
+			return
+		}
+
+		inputs, err := parseEmbeddingInput(req.Input)
+		if err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+
+		start := time.Now()
+		resp, err := embedder.Embed(r.Context(), req.Model, inputs, req.Dimensions)
+		if err != nil {
+			recordUsage(db, r, req.Model, start, 0, 0, err)
+			log.Printf("Embed error: %v", err)
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("Embedding failed: %v", err))
+			return
+		}
+		recordUsage(db, r, req.Model, start, resp.PromptTokens, 0, nil)
+
+		data := make([]openAIEmbedding, len(resp.Embeddings))
+		for i, vec := range resp.Embeddings {
+			data[i] = openAIEmbedding{Object: "embedding", Index: i, Embedding: vec}
+			if req.EncodingFormat == "base64" {
+				data[i].Embedding = encodeEmbeddingBase64(vec)
+			}
+		}
+
+		writeJSON(w, http.StatusOK, openAIEmbeddingResponse{
+			Object: "list",
+			Data:   data,
+			Model:  req.Model,
+			Usage:  openAIEmbedUsage{PromptTokens: resp.PromptTokens, TotalTokens: resp.PromptTokens},
+		})
+	}
+}
+
+// parseEmbeddingInput accepts a string or an array of strings. Token-ID
+// arrays are valid OpenAI input but Ollama can only embed text.
+func parseEmbeddingInput(raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, fmt.Errorf("Missing required parameter: 'input'.")
+	}
+
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if single == "" {
+			return nil, fmt.Errorf("'input' must not be empty.")
+		}
+		return []string{single}, nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, fmt.Errorf("'input' must be a string or an array of strings; token arrays are not supported.")
+	}
+	if len(many) == 0 {
+		return nil, fmt.Errorf("'input' must not be empty.")
+	}
+	for i, s := range many {
+		if s == "" {
+			return nil, fmt.Errorf("'input[%d]' must not be empty.", i)
+		}
+	}
+	return many, nil
+}
+
+// encodeEmbeddingBase64 packs a vector as little-endian float32s, the format the OpenAI SDKs decode.
+func encodeEmbeddingBase64(vec []float32) string {
+	buf := make([]byte, 4*len(vec))
+	for i, f := range vec {
+		binary.LittleEndian.PutUint32(buf[4*i:], math.Float32bits(f))
+	}
+	return base64.StdEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// activeGeneration is a streaming web chat that is currently generating.
+type activeGeneration struct {
+	ConversationID int       `json:"conversation_id"`
+	UserID         int       `json:"user_id"`
+	Username       string    `json:"username"`
+	Model          string    `json:"model"`
+	StartedAt      time.Time `json:"started_at"`
+
+	cancel  context.CancelFunc
+	stopped atomic.Bool   // set when stopped on request rather than by a disconnect
+	done    chan struct{} // closed once the handler has saved the partial response
+}
+
+// generationRegistry tracks in-flight web chat streams by conversation so
+// they can be stopped from another request.
+type generationRegistry struct {
+	mu     sync.Mutex
+	byConv map[int]*activeGeneration
+}
+
+var activeGenerations = &generationRegistry{byConv: make(map[int]*activeGeneration)}
+
+// stopWaitTimeout bounds how long a stop request waits for the partial response to be saved.
+const stopWaitTimeout = 5 * time.Second
+
+// Register records a generation for the conversation. It returns nil if the
+// conversation is already generating.
+func (g *generationRegistry) Register(convID int, user *User, model string, cancel context.CancelFunc) *activeGeneration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, busy := g.byConv[convID]; busy {
+		return nil
+	}
+	gen := &activeGeneration{
+		ConversationID: convID,
+		UserID:         user.ID,
+		Username:       user.Username,
+		Model:          model,
+		StartedAt:      time.Now().UTC(),
+		cancel:         cancel,
+		done:           make(chan struct{}),
+	}
+	g.byConv[convID] = gen
+	return gen
+}
+
+// Finish removes a generation once its handler is done with it.
+func (g *generationRegistry) Finish(gen *activeGeneration) {
+	g.mu.Lock()
+	if g.byConv[gen.ConversationID] == gen {
+		delete(g.byConv, gen.ConversationID)
+	}
+	g.mu.Unlock()
+	close(gen.done)
+}
+
+// Stop cancels the conversation's generation and waits briefly for the
+// partial response to be saved. userID 0 stops any user's generation (admin).
+func (g *generationRegistry) Stop(convID, userID int) bool {
+	g.mu.Lock()
+	gen, ok := g.byConv[convID]
+	g.mu.Unlock()
+	if !ok || (userID != 0 && gen.UserID != userID) {
+		return false
+	}
+
+	gen.stopped.Store(true)
+	gen.cancel()
+	select {
+	case <-gen.done:
+	case <-time.After(stopWaitTimeout):
+	}
+	return true
+}
+
+// List returns all active generations, oldest first.
+func (g *generationRegistry) List() []activeGeneration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]activeGeneration, 0, len(g.byConv))
+	for _, gen := range g.byConv {
+		out = append(out, activeGeneration{
+			ConversationID: gen.ConversationID,
+			UserID:         gen.UserID,
+			Username:       gen.Username,
+			Model:          gen.Model,
+			StartedAt:      gen.StartedAt,
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAt.Before(out[j].StartedAt) })
+	return out
+}
+
+// StopAll cancels every active generation, e.g. when the server is reset.
+func (g *generationRegistry) StopAll() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, gen := range g.byConv {
+		gen.stopped.Store(true)
+		gen.cancel()
+	}
+}
+
+// --- Handlers ---
+
+// handleStopGeneration handles POST /api/conversations/{id}/stop
+func handleStopGeneration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid conversation ID"})
+			return
+		}
+
+		if !activeGenerations.Stop(id, user.ID) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active generation for this conversation"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "stopped"})
+	}
+}
+
+// handleListGenerations handles GET /api/admin/generations
+func handleListGenerations() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]any{"generations": activeGenerations.List()})
+	}
+}
+
+// handleKillGeneration handles DELETE /api/admin/generations/{id}, where id is the conversation ID.
+func handleKillGeneration() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid conversation ID"})
+			return
+		}
+
+		if !activeGenerations.Stop(id, 0) {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "no active generation for this conversation"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "stopped"})
+	}
+}
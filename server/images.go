@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// maxImageBytes caps a single decoded image so one request can't exhaust memory.
+const maxImageBytes = 20 << 20
+
+// contentError reports an unusable message content part. Handlers surface its
+// message to the client instead of a generic parse error.
+type contentError struct {
+	msg string
+}
+
+func (e *contentError) Error() string { return e.msg }
+
+// contentPart is one element of an OpenAI content array.
+type contentPart struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text"`
+	ImageURL json.RawMessage `json:"image_url"` // {"url": "..."} or, in some clients, a bare string
+}
+
+// UnmarshalJSON accepts content as a plain string (Ollama and simple OpenAI
+// clients) or as an OpenAI array of text and image_url parts. Text parts are
+// joined into Content; data-URL images are decoded into Images.
+func (m *ChatMessage) UnmarshalJSON(data []byte) error {
+	type plain ChatMessage
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*m = ChatMessage(raw.plain)
+
+	if len(raw.Content) == 0 || string(raw.Content) == "null" {
+		return nil
+	}
+	if raw.Content[0] == '"' {
+		return json.Unmarshal(raw.Content, &m.Content)
+	}
+
+	var parts []contentPart
+	if err := json.Unmarshal(raw.Content, &parts); err != nil {
+		return &contentError{"message content must be a string or an array of content parts"}
+	}
+
+	var texts []string
+	for i, p := range parts {
+		switch p.Type {
+		case "text":
+			texts = append(texts, p.Text)
+		case "image_url":
+			img, err := parseImageURLPart(p.ImageURL)
+			if err != nil {
+				return &contentError{fmt.Sprintf("content[%d]: %v", i, err)}
+			}
+			m.Images = append(m.Images, img)
+		default:
+			return &contentError{fmt.Sprintf("content[%d]: unsupported content part type %q", i, p.Type)}
+		}
+	}
+	m.Content = strings.Join(texts, "\n")
+	return nil
+}
+
+func parseImageURLPart(raw json.RawMessage) (string, error) {
+	var url string
+	if err := json.Unmarshal(raw, &url); err != nil {
+		var obj struct {
+			URL string `json:"url"`
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return "", fmt.Errorf("image_url must be an object with a url")
+		}
+		url = obj.URL
+	}
+	return decodeImageData(url)
+}
+
+// decodeImageData validates an image given as a data URL or bare base64 and
+// returns its base64 payload. Remote URLs are rejected because the server
+// makes no outbound fetches on a client's behalf.
+func decodeImageData(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://") {
+		return "", fmt.Errorf("remote image URLs are not supported; send the image inline as a base64 data URL (data:image/png;base64,...)")
+	}
+	if strings.HasPrefix(s, "data:") {
+		comma := strings.IndexByte(s, ',')
+		if comma < 0 || !strings.HasSuffix(s[:comma], ";base64") {
+			return "", fmt.Errorf("image data URLs must be base64-encoded")
+		}
+		s = s[comma+1:]
+	}
+	if s == "" {
+		return "", fmt.Errorf("image data is empty")
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("image data is not valid base64")
+	}
+	if len(decoded) > maxImageBytes {
+		return "", fmt.Errorf("image exceeds the %d MB limit", maxImageBytes>>20)
+	}
+	return s, nil
+}
+
+// decodeImageList validates the image attachments of a web chat request.
+func decodeImageList(images []string) ([]string, error) {
+	out := make([]string, 0, len(images))
+	for i, img := range images {
+		data, err := decodeImageData(img)
+		if err != nil {
+			return nil, fmt.Errorf("images[%d]: %v", i, err)
+		}
+		out = append(out, data)
+	}
+	return out, nil
+}
@@ -17,13 +17,15 @@ type Invite struct {
 	MaxUses   int        `json:"max_uses"`
 	Uses      int        `json:"uses"`
 	ExpiresAt *time.Time `json:"expires_at,omitempty"`
-	CreatedAt time.Time  `json:"created_at"`
+	// ModelPolicy is copied to users who register with the invite.
+	ModelPolicy *ModelPolicy `json:"model_policy,omitempty"`
+	CreatedAt   time.Time    `json:"created_at"`
 }
 
 // --- Database methods ---
 
 // CreateInvite generates a new invite link with its own encryption key.
-func (db *DB) CreateInvite(createdBy int, maxUses int, expiresAt *time.Time) (*Invite, string, error) {
+func (db *DB) CreateInvite(createdBy int, maxUses int, expiresAt *time.Time, policy *ModelPolicy) (*Invite, string, error) {
 	token, err := randomURLSafe(18)
 	if err != nil {
 		return nil, "", fmt.Errorf("generating token: %w", err)
@@ -35,20 +37,21 @@ func (db *DB) CreateInvite(createdBy int, maxUses int, expiresAt *time.Time) (*I
 	}
 
 	result, err := db.conn.Exec(`
-		INSERT INTO invite_links (token, encryption_key, created_by, max_uses, expires_at)
-		VALUES (?, ?, ?, ?, ?)
-	`, token, encKey, createdBy, maxUses, expiresAt)
+		INSERT INTO invite_links (token, encryption_key, created_by, max_uses, expires_at, model_policy)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, token, encKey, createdBy, maxUses, expiresAt, encodeModelPolicy(policy))
 	if err != nil {
 		return nil, "", fmt.Errorf("inserting invite: %w", err)
 	}
 
 	id, _ := result.LastInsertId()
 	invite := &Invite{
-		ID:        int(id),
-		Token:     token,
-		MaxUses:   maxUses,
-		Uses:      0,
-		ExpiresAt: expiresAt,
+		ID:          int(id),
+		Token:       token,
+		MaxUses:     maxUses,
+		Uses:        0,
+		ExpiresAt:   expiresAt,
+		ModelPolicy: policy,
 	}
 
 	encKeyB64 := base64.URLEncoding.EncodeToString(encKey)
@@ -60,13 +63,14 @@ func (db *DB) CreateInvite(createdBy int, maxUses int, expiresAt *time.Time) (*I
 func (db *DB) ValidateInvite(token string) (*Invite, []byte, error) {
 	var invite Invite
 	var encKey []byte
+	var policy sql.NullString
 
 	err := db.conn.QueryRow(`
-		SELECT id, token, encryption_key, max_uses, uses, expires_at, created_at
+		SELECT id, token, encryption_key, max_uses, uses, expires_at, model_policy, created_at
 		FROM invite_links WHERE token = ?
 	`, token).Scan(
 		&invite.ID, &invite.Token, &encKey,
-		&invite.MaxUses, &invite.Uses, &invite.ExpiresAt, &invite.CreatedAt,
+		&invite.MaxUses, &invite.Uses, &invite.ExpiresAt, &policy, &invite.CreatedAt,
 	)
 	if err == sql.ErrNoRows {
 		return nil, nil, nil
@@ -74,6 +78,7 @@ func (db *DB) ValidateInvite(token string) (*Invite, []byte, error) {
 	if err != nil {
 		return nil, nil, fmt.Errorf("querying invite: %w", err)
 	}
+	invite.ModelPolicy = decodeModelPolicy(policy)
 
 	if invite.Uses >= invite.MaxUses {
 		return nil, nil, nil
@@ -94,7 +99,7 @@ func (db *DB) ConsumeInvite(inviteID int) error {
 // ListInvites returns all invites (for admin dashboard).
 func (db *DB) ListInvites() ([]Invite, error) {
 	rows, err := db.conn.Query(`
-		SELECT id, token, max_uses, uses, expires_at, created_at
+		SELECT id, token, max_uses, uses, expires_at, model_policy, created_at
 		FROM invite_links ORDER BY created_at DESC
 	`)
 	if err != nil {
@@ -105,9 +110,11 @@ func (db *DB) ListInvites() ([]Invite, error) {
 	var invites []Invite
 	for rows.Next() {
 		var inv Invite
-		if err := rows.Scan(&inv.ID, &inv.Token, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &inv.CreatedAt); err != nil {
+		var policy sql.NullString
+		if err := rows.Scan(&inv.ID, &inv.Token, &inv.MaxUses, &inv.Uses, &inv.ExpiresAt, &policy, &inv.CreatedAt); err != nil {
 			return nil, err
 		}
+		inv.ModelPolicy = decodeModelPolicy(policy)
 		invites = append(invites, inv)
 	}
 	return invites, rows.Err()
@@ -125,8 +132,9 @@ func (db *DB) DeleteInvite(id int) error {
 func handleCreateInvite(db *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			MaxUses   int    `json:"max_uses"`
-			ExpiresIn string `json:"expires_in"` // e.g. "24h", "7d", "" for never
+			MaxUses     int          `json:"max_uses"`
+			ExpiresIn   string       `json:"expires_in"` // e.g. "24h", "7d", "" for never
+			ModelPolicy *ModelPolicy `json:"model_policy"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
@@ -136,6 +144,12 @@ func handleCreateInvite(db *DB) http.HandlerFunc {
 		if req.MaxUses <= 0 {
 			req.MaxUses = 1
 		}
+		if req.ModelPolicy != nil {
+			if err := req.ModelPolicy.validate(); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+		}
 
 		var expiresAt *time.Time
 		if req.ExpiresIn != "" {
@@ -149,7 +163,7 @@ func handleCreateInvite(db *DB) http.HandlerFunc {
 		}
 
 		user := UserFromContext(r.Context())
-		invite, encKeyB64, err := db.CreateInvite(user.ID, req.MaxUses, expiresAt)
+		invite, encKeyB64, err := db.CreateInvite(user.ID, req.MaxUses, expiresAt, req.ModelPolicy)
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("failed to create invite: %v", err)})
 			return
@@ -258,12 +272,19 @@ func handleRegister(db *DB) http.HandlerFunc {
 			return
 		}
 
+		if invite.ModelPolicy != nil {
+			if err := db.SetUserModelPolicy(user.ID, invite.ModelPolicy); err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "account created but model policy failed"})
+				return
+			}
+		}
+
 		if err := db.ConsumeInvite(invite.ID); err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "account created but invite tracking failed"})
 			return
 		}
 
-		sessionID, err := db.CreateSession(user.ID)
+		sessionID, err := db.CreateSession(user.ID, getIP(r), r.UserAgent())
 		if err != nil {
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "account created but session failed"})
 			return
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// validateJSONSchema checks that data is valid JSON matching schema.
+// It covers the subset of JSON Schema that structured-output schemas use in
+// practice: type, properties, required, additionalProperties, items, enum,
+// const, anyOf/oneOf/allOf, local $ref, numeric and length bounds, and pattern.
+func validateJSONSchema(schema json.RawMessage, data []byte) error {
+	var root map[string]any
+	if err := json.Unmarshal(schema, &root); err != nil {
+		return fmt.Errorf("invalid schema: %w", err)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.UseNumber()
+	var value any
+	if err := dec.Decode(&value); err != nil {
+		return fmt.Errorf("output is not valid JSON: %w", err)
+	}
+	if dec.More() {
+		return fmt.Errorf("output has trailing data after the JSON value")
+	}
+
+	v := schemaValidator{root: root, refs: make(map[string]bool)}
+	return v.validate(root, value, "$")
+}
+
+// maxSchemaRefDepth bounds how many $refs may be followed at once, so a
+// recursive schema can't exhaust the stack on deeply nested output.
+const maxSchemaRefDepth = 32
+
+type schemaValidator struct {
+	root map[string]any
+	refs map[string]bool // $refs being followed, keyed by ref and value path
+}
+
+func (v schemaValidator) validate(schema map[string]any, value any, path string) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		key := ref + " " + path
+		if v.refs[key] {
+			return fmt.Errorf("%s: cyclic $ref %q", path, ref)
+		}
+		if len(v.refs) >= maxSchemaRefDepth {
+			return fmt.Errorf("%s: $refs nested more than %d deep", path, maxSchemaRefDepth)
+		}
+		target, err := v.resolve(ref)
+		if err != nil {
+			return err
+		}
+		v.refs[key] = true
+		defer delete(v.refs, key)
+		return v.validate(target, value, path)
+	}
+
+	if t, ok := schema["type"]; ok {
+		if err := checkType(t, value, path); err != nil {
+			return err
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: value is not one of the allowed enum values", path)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		return fmt.Errorf("%s: value does not match const", path)
+	}
+
+	if err := v.validateCombinators(schema, value, path); err != nil {
+		return err
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		return v.validateObject(schema, val, path)
+	case []any:
+		return v.validateArray(schema, val, path)
+	case string:
+		return validateString(schema, val, path)
+	case json.Number:
+		return validateNumber(schema, val, path)
+	}
+	return nil
+}
+
+func (v schemaValidator) validateCombinators(schema map[string]any, value any, path string) error {
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, s := range all {
+			sub, _ := s.(map[string]any)
+			if err := v.validate(sub, value, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, s := range anyOf {
+			sub, _ := s.(map[string]any)
+			if v.validate(sub, value, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value matches none of anyOf", path)
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		matches := 0
+		for _, s := range oneOf {
+			sub, _ := s.(map[string]any)
+			if v.validate(sub, value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s: value must match exactly one of oneOf, matched %d", path, matches)
+		}
+	}
+	return nil
+}
+
+func (v schemaValidator) validateObject(schema map[string]any, obj map[string]any, path string) error {
+	if required, ok := schema["required"].([]any); ok {
+		for _, r := range required {
+			name, _ := r.(string)
+			if _, present := obj[name]; !present {
+				return fmt.Errorf("%s: missing required property %q", path, name)
+			}
+		}
+	}
+
+	props, _ := schema["properties"].(map[string]any)
+	for name, val := range obj {
+		if propSchema, ok := props[name].(map[string]any); ok {
+			if err := v.validate(propSchema, val, path+"."+name); err != nil {
+				return err
+			}
+			continue
+		}
+		switch extra := schema["additionalProperties"].(type) {
+		case bool:
+			if !extra {
+				return fmt.Errorf("%s: unexpected property %q", path, name)
+			}
+		case map[string]any:
+			if err := v.validate(extra, val, path+"."+name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (v schemaValidator) validateArray(schema map[string]any, arr []any, path string) error {
+	if min, ok := schemaInt(schema, "minItems"); ok && len(arr) < min {
+		return fmt.Errorf("%s: expected at least %d items, got %d", path, min, len(arr))
+	}
+	if max, ok := schemaInt(schema, "maxItems"); ok && len(arr) > max {
+		return fmt.Errorf("%s: expected at most %d items, got %d", path, max, len(arr))
+	}
+	if items, ok := schema["items"].(map[string]any); ok {
+		for i, item := range arr {
+			if err := v.validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func validateString(schema map[string]any, s, path string) error {
+	n := utf8.RuneCountInString(s)
+	if min, ok := schemaInt(schema, "minLength"); ok && n < min {
+		return fmt.Errorf("%s: string shorter than %d characters", path, min)
+	}
+	if max, ok := schemaInt(schema, "maxLength"); ok && n > max {
+		return fmt.Errorf("%s: string longer than %d characters", path, max)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid pattern %q: %v", path, pattern, err)
+		}
+		if !re.MatchString(s) {
+			return fmt.Errorf("%s: string does not match pattern %q", path, pattern)
+		}
+	}
+	return nil
+}
+
+func validateNumber(schema map[string]any, n json.Number, path string) error {
+	f, err := n.Float64()
+	if err != nil {
+		return fmt.Errorf("%s: invalid number", path)
+	}
+	if min, ok := schema["minimum"].(float64); ok && f < min {
+		return fmt.Errorf("%s: %v is less than minimum %v", path, f, min)
+	}
+	if max, ok := schema["maximum"].(float64); ok && f > max {
+		return fmt.Errorf("%s: %v is greater than maximum %v", path, f, max)
+	}
+	if min, ok := schema["exclusiveMinimum"].(float64); ok && f <= min {
+		return fmt.Errorf("%s: %v must be greater than %v", path, f, min)
+	}
+	if max, ok := schema["exclusiveMaximum"].(float64); ok && f >= max {
+		return fmt.Errorf("%s: %v must be less than %v", path, f, max)
+	}
+	return nil
+}
+
+// checkType validates the JSON type of value against a "type" keyword (string or list).
+func checkType(t any, value any, path string) error {
+	var types []string
+	switch tt := t.(type) {
+	case string:
+		types = []string{tt}
+	case []any:
+		for _, x := range tt {
+			if s, ok := x.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+
+	for _, want := range types {
+		if jsonTypeMatches(want, value) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: expected %s, got %s", path, strings.Join(types, " or "), jsonTypeName(value))
+}
+
+func jsonTypeMatches(want string, value any) bool {
+	switch want {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "number":
+		_, ok := value.(json.Number)
+		return ok
+	case "integer":
+		n, ok := value.(json.Number)
+		if !ok {
+			return false
+		}
+		f, err := n.Float64()
+		return err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+func jsonTypeName(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case json.Number:
+		return "number"
+	}
+	return "unknown"
+}
+
+// resolve follows a local JSON pointer such as "#/$defs/Address".
+func (v schemaValidator) resolve(ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q (only local references are allowed)", ref)
+	}
+	var node any = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("unresolvable $ref %q", ref)
+		}
+		node = m[part]
+	}
+	target, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("unresolvable $ref %q", ref)
+	}
+	return target, nil
+}
+
+// checkSchema rejects a schema no output could ever be validated against:
+// one whose $refs don't resolve or loop back to themselves without
+// descending into the value (such as {"$ref":"#"}), or whose patterns aren't
+// valid regular expressions.
+func checkSchema(root map[string]any) error {
+	v := schemaValidator{root: root}
+	var err error
+	walkSchema(root, func(schema map[string]any) {
+		if err != nil {
+			return
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			if _, perr := regexp.Compile(pattern); perr != nil {
+				err = fmt.Errorf("invalid pattern %q: %v", pattern, perr)
+				return
+			}
+		}
+		err = v.checkRefCycle(schema, make(map[string]bool))
+	})
+	return err
+}
+
+// checkRefCycle follows the $refs and combinators that apply to the same
+// value as schema, the way validate does, failing if a $ref repeats.
+func (v schemaValidator) checkRefCycle(schema map[string]any, stack map[string]bool) error {
+	if ref, ok := schema["$ref"].(string); ok {
+		if stack[ref] {
+			return fmt.Errorf("cyclic $ref %q", ref)
+		}
+		target, err := v.resolve(ref)
+		if err != nil {
+			return err
+		}
+		stack[ref] = true
+		defer delete(stack, ref)
+		return v.checkRefCycle(target, stack)
+	}
+	for _, keyword := range []string{"allOf", "anyOf", "oneOf"} {
+		list, _ := schema[keyword].([]any)
+		for _, s := range list {
+			if sub, ok := s.(map[string]any); ok {
+				if err := v.checkRefCycle(sub, stack); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// walkSchema calls fn for every object in a schema document, without following $refs.
+func walkSchema(node any, fn func(map[string]any)) {
+	switch n := node.(type) {
+	case map[string]any:
+		fn(n)
+		for key, child := range n {
+			if key != "enum" && key != "const" { // literal values, not schemas
+				walkSchema(child, fn)
+			}
+		}
+	case []any:
+		for _, child := range n {
+			walkSchema(child, fn)
+		}
+	}
+}
+
+func schemaInt(schema map[string]any, key string) (int, bool) {
+	f, ok := schema[key].(float64)
+	return int(f), ok
+}
+
+// jsonEqual compares a schema literal (decoded with float64 numbers) to a
+// value decoded with json.Number.
+func jsonEqual(schemaVal, value any) bool {
+	if n, ok := value.(json.Number); ok {
+		f, err := n.Float64()
+		sf, ok := schemaVal.(float64)
+		return err == nil && ok && f == sf
+	}
+	return reflect.DeepEqual(schemaVal, normalizeNumbers(value))
+}
+
+// normalizeNumbers converts json.Number values to float64 so they compare equal to schema literals.
+func normalizeNumbers(value any) any {
+	switch val := value.(type) {
+	case json.Number:
+		f, _ := val.Float64()
+		return f
+	case map[string]any:
+		out := make(map[string]any, len(val))
+		for k, x := range val {
+			out[k] = normalizeNumbers(x)
+		}
+		return out
+	case []any:
+		out := make([]any, len(val))
+		for i, x := range val {
+			out[i] = normalizeNumbers(x)
+		}
+		return out
+	}
+	return value
+}
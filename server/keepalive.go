@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ModelSettings holds per-model load behaviour. KeepAlive is applied to every
+// chat request for the model; a pinned model is kept loaded indefinitely and
+// reloaded whenever it is found evicted.
+type ModelSettings struct {
+	Model     string    `json:"model"`
+	KeepAlive string    `json:"keep_alive,omitempty"` // e.g. "30m", "-1"; "" = Ollama's default
+	Pinned    bool      `json:"pinned"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// keepAlive returns the keep-alive to send with requests for the model.
+func (s *ModelSettings) keepAlive() string {
+	if s == nil {
+		return ""
+	}
+	if s.Pinned {
+		return "-1"
+	}
+	return s.KeepAlive
+}
+
+// pinnedModelCheckInterval is how often pinned models are checked and re-warmed.
+const pinnedModelCheckInterval = time.Minute
+
+// keepAliveValue converts a keep-alive setting to the JSON value Ollama
+// expects: whole numbers are seconds, anything else a duration string.
+func keepAliveValue(s string) any {
+	if s == "" {
+		return nil
+	}
+	if n, err := strconv.Atoi(s); err == nil {
+		return n
+	}
+	return s
+}
+
+func validateKeepAlive(s string) error {
+	if s == "" {
+		return nil
+	}
+	if _, err := strconv.Atoi(s); err == nil {
+		return nil
+	}
+	if _, err := time.ParseDuration(s); err != nil {
+		return fmt.Errorf("invalid keep_alive %q (use a duration like '30m', seconds, or -1 for forever)", s)
+	}
+	return nil
+}
+
+// --- Database methods ---
+
+// GetModelSettings returns the settings for a model, or nil if it has none.
+func (db *DB) GetModelSettings(model string) (*ModelSettings, error) {
+	var s ModelSettings
+	var keepAlive sql.NullString
+	err := db.conn.QueryRow(`
+		SELECT model, keep_alive, pinned, updated_at FROM model_settings WHERE model = ?
+	`, normalizeModelName(model)).Scan(&s.Model, &keepAlive, &s.Pinned, &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.KeepAlive = keepAlive.String
+	return &s, nil
+}
+
+// ListModelSettings returns the settings of every configured model.
+func (db *DB) ListModelSettings() ([]ModelSettings, error) {
+	rows, err := db.conn.Query(`SELECT model, keep_alive, pinned, updated_at FROM model_settings ORDER BY model`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var settings []ModelSettings
+	for rows.Next() {
+		var s ModelSettings
+		var keepAlive sql.NullString
+		if err := rows.Scan(&s.Model, &keepAlive, &s.Pinned, &s.UpdatedAt); err != nil {
+			return nil, err
+		}
+		s.KeepAlive = keepAlive.String
+		settings = append(settings, s)
+	}
+	return settings, rows.Err()
+}
+
+// SetModelSettings stores a model's settings, removing them when they are all defaults.
+func (db *DB) SetModelSettings(s ModelSettings) error {
+	model := normalizeModelName(s.Model)
+	if s.KeepAlive == "" && !s.Pinned {
+		_, err := db.conn.Exec(`DELETE FROM model_settings WHERE model = ?`, model)
+		return err
+	}
+	_, err := db.conn.Exec(`
+		INSERT INTO model_settings (model, keep_alive, pinned, updated_at)
+		VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+		ON CONFLICT(model) DO UPDATE SET keep_alive = excluded.keep_alive, pinned = excluded.pinned, updated_at = CURRENT_TIMESTAMP
+	`, model, s.KeepAlive, s.Pinned)
+	return err
+}
+
+// --- Pinned models ---
+
+// warmPinnedModels loads any pinned model that is not currently loaded.
+func warmPinnedModels(ctx context.Context, db *DB, backend Backend, loader ModelLoader) {
+	settings, err := db.ListModelSettings()
+	if err != nil {
+		log.Printf("Pinned models: %v", err)
+		return
+	}
+	var pinned []string
+	for _, s := range settings {
+		if s.Pinned {
+			pinned = append(pinned, s.Model)
+		}
+	}
+	if len(pinned) == 0 {
+		return
+	}
+
+	running, err := backend.ListRunningModels()
+	if err != nil {
+		log.Printf("Pinned models: listing loaded models: %v", err)
+		return
+	}
+	loaded := make(map[string]bool, len(running))
+	for _, m := range running {
+		loaded[normalizeModelName(m.Name)] = true
+	}
+
+	for _, model := range pinned {
+		if loaded[model] {
+			continue
+		}
+		if err := loader.LoadModel(ctx, model, "-1"); err != nil {
+			log.Printf("Pinned models: loading %s: %v", model, err)
+			continue
+		}
+		log.Printf("Pinned models: loaded %s", model)
+	}
+}
+
+// runPinnedModelWarmer warms pinned models now and then every interval until ctx is cancelled.
+func runPinnedModelWarmer(ctx context.Context, db *DB, backend Backend, loader ModelLoader, interval time.Duration) {
+	warmPinnedModels(ctx, db, backend, loader)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			warmPinnedModels(ctx, db, backend, loader)
+		}
+	}
+}
+
+// --- HTTP handlers ---
+
+// handleLoadModel handles POST /api/admin/models/load
+func handleLoadModel(db *DB, backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model     string `json:"model"`
+			KeepAlive string `json:"keep_alive"` // defaults to the model's configured keep-alive
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model is required"})
+			return
+		}
+		if err := validateKeepAlive(req.KeepAlive); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		loader, ok := backend.(ModelLoader)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "loading models is " + errBackendUnsupported.Error()})
+			return
+		}
+
+		if req.KeepAlive == "" {
+			settings, err := db.GetModelSettings(req.Model)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load model settings"})
+				return
+			}
+			req.KeepAlive = settings.keepAlive()
+		}
+
+		if err := loader.LoadModel(r.Context(), req.Model, req.KeepAlive); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("failed to load model: %v", err)})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "loaded", "model": req.Model, "keep_alive": req.KeepAlive})
+	}
+}
+
+// handleUnloadModel handles POST /api/admin/models/unload
+func handleUnloadModel(backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model is required"})
+			return
+		}
+		loader, ok := backend.(ModelLoader)
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "unloading models is " + errBackendUnsupported.Error()})
+			return
+		}
+
+		if err := loader.LoadModel(r.Context(), req.Model, "0"); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("failed to unload model: %v", err)})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "unloaded", "model": req.Model})
+	}
+}
+
+// handleListModelSettings handles GET /api/admin/models/settings
+func handleListModelSettings(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		settings, err := db.ListModelSettings()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list model settings"})
+			return
+		}
+		if settings == nil {
+			settings = []ModelSettings{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"settings": settings})
+	}
+}
+
+// handleSetModelSettings handles PUT /api/admin/models/settings. A newly
+// pinned model is loaded right away.
+func handleSetModelSettings(db *DB, backend Backend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ModelSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model is required"})
+			return
+		}
+		if err := validateKeepAlive(req.KeepAlive); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		loader, canLoad := backend.(ModelLoader)
+		if req.Pinned && !canLoad {
+			writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "pinning models is " + errBackendUnsupported.Error()})
+			return
+		}
+
+		if err := db.SetModelSettings(req); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save model settings"})
+			return
+		}
+
+		if req.Pinned {
+			if err := loader.LoadModel(r.Context(), req.Model, "-1"); err != nil {
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("settings saved, but loading the model failed: %v", err)})
+				return
+			}
+		}
+		req.Model = normalizeModelName(req.Model)
+		req.UpdatedAt = time.Now().UTC()
+		writeJSON(w, http.StatusOK, map[string]any{"settings": req})
+	}
+}
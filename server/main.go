@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fireside/ui"
 	"flag"
 	"fmt"
@@ -33,12 +34,23 @@ func defaultDataDir() string {
 
 func main() {
 	port := flag.Int("port", 7654, "port to listen on")
-	ollamaURL := flag.String("ollama-url", "http://localhost:11434", "Ollama API base URL")
+	var ollamaURLs urlListFlag
+	flag.Var(&ollamaURLs, "ollama-url", "Ollama API base URL; repeat or comma-separate to route across several servers (default http://localhost:11434)")
+	backendKind := flag.String("backend", "ollama", "inference backend: \"ollama\" or \"openai\" (any OpenAI-compatible server)")
+	upstreamURL := flag.String("upstream-url", "", "OpenAI-compatible API base URL including /v1, e.g. http://localhost:8080/v1 (with --backend openai)")
+	upstreamKey := flag.String("upstream-api-key", os.Getenv("FIRESIDE_UPSTREAM_API_KEY"), "API key for the OpenAI-compatible upstream (with --backend openai)")
 	dataDir := flag.String("data-dir", defaultDataDir(), "data directory for database and config")
 	resetAdminPassword := flag.String("reset-admin", "", "force completely resets the password for the admin account to the specified password")
 	noTunnel := flag.Bool("no-tunnel", false, "disable Cloudflare tunnel (server is only accessible on localhost)")
 	verbose := flag.Bool("verbose", false, "show detailed startup logs")
+	maxConcurrent := flag.Int("max-concurrent", 4, "inference calls sent to the backend at once (0 = unlimited)")
+	maxQueue := flag.Int("max-queue", 64, "inference calls allowed to wait for a slot before new ones get 503 (0 = unlimited)")
+	queueTimeout := flag.Duration("queue-timeout", 2*time.Minute, "longest an inference call waits in the queue (0 = no limit)")
+	maxPulls := flag.Int("max-pulls", 2, "model downloads run at once; further pulls wait their turn (0 = unlimited)")
 	flag.Parse()
+	if len(ollamaURLs) == 0 {
+		ollamaURLs = urlListFlag{"http://localhost:11434"}
+	}
 
 	// Helper for debug-level logging (only shown with --verbose)
 	debugf := func(format string, args ...any) {
@@ -84,12 +96,32 @@ func main() {
 
 	initPauseState(db)
 
-	ollama := NewOllamaClient(*ollamaURL)
+	backend, err := NewBackend(*backendKind, ollamaURLs, *upstreamURL, *upstreamKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\n  ✗ %v\n\n", err)
+		os.Exit(1)
+	}
+	debugf("Backend: %s", backend)
+
+	inferenceQueue = NewScheduler(*maxConcurrent, *maxQueue, *queueTimeout)
 
 	// --- Tunnel provider ---
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// Background workers get their own context: ctx is replaced when the tunnel is hot-swapped
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	if pool, ok := backend.(*UpstreamPool); ok {
+		pool.Refresh()
+		go pool.Run(workers, 15*time.Second)
+	}
+	if loader, ok := backend.(ModelLoader); ok {
+		go runPinnedModelWarmer(workers, db, backend, loader, pinnedModelCheckInterval)
+	}
+	pullJobs := NewPullJobs(workers, db, backend, *maxPulls)
+
 	var tunnel TunnelProvider
 	var tunnelURL string
 
@@ -209,19 +241,38 @@ func main() {
 	mux.HandleFunc("GET /api/setup/status", handleSetupStatus(db))
 	mux.HandleFunc("POST /api/setup", handleSetup(db))
 	mux.HandleFunc("POST /api/auth/login", handleLogin(db))
+	mux.HandleFunc("POST /api/auth/login/2fa", handleLoginTwoFactor(db))
+	mux.HandleFunc("POST /api/auth/passkeys/login/begin", handlePasskeyLoginBegin(db))
+	mux.HandleFunc("POST /api/auth/passkeys/login/finish", handlePasskeyLoginFinish(db))
+	mux.HandleFunc("GET /api/auth/oidc", handleOIDCStatus(db))
+	mux.HandleFunc("GET /api/auth/oidc/login", handleOIDCLogin(db))
+	mux.HandleFunc("GET /api/auth/oidc/callback", handleOIDCCallback(db))
 	mux.HandleFunc("POST /api/auth/logout", handleLogout(db))
 	mux.HandleFunc("POST /api/auth/register", handleRegister(db))
 	mux.HandleFunc("GET /api/invite/{token}", handleValidateInvite(db))
 
 	// Authenticated endpoints
 	mux.HandleFunc("GET /api/auth/me", requireAuth(db, handleMe(db)))
-	mux.HandleFunc("GET /api/models", requireAuth(db, handleListModels(ollama)))
-	mux.HandleFunc("POST /api/chat", requireAuth(db, handleChatWithHistory(db, ollama)))
-	mux.HandleFunc("POST /api/chat/stream", requireAuth(db, handleChatStreamWithHistory(db, ollama)))
+	mux.HandleFunc("GET /api/models", requireAuth(db, handleListModels(db, backend)))
+	mux.HandleFunc("POST /api/chat", requireAuth(db, requireQuota(db, handleChatWithHistory(db, backend))))
+	mux.HandleFunc("POST /api/chat/stream", requireAuth(db, requireQuota(db, handleChatStreamWithHistory(db, backend))))
 	mux.HandleFunc("GET /api/conversations", requireAuth(db, handleListConversations(db)))
 	mux.HandleFunc("GET /api/conversations/{id}", requireAuth(db, handleGetConversation(db)))
 	mux.HandleFunc("DELETE /api/conversations/{id}", requireAuth(db, handleDeleteConversation(db)))
+	mux.HandleFunc("POST /api/conversations/{id}/stop", requireAuth(db, handleStopGeneration()))
 	mux.HandleFunc("PUT /api/auth/password", requireAuth(db, handleChangePassword(db)))
+	mux.HandleFunc("GET /api/auth/sessions", requireAuth(db, handleListSessions(db)))
+	mux.HandleFunc("DELETE /api/auth/sessions", requireAuth(db, handleRevokeOtherSessions(db)))
+	mux.HandleFunc("DELETE /api/auth/sessions/{id}", requireAuth(db, handleRevokeSession(db)))
+	mux.HandleFunc("GET /api/auth/2fa", requireAuth(db, handleTwoFactorStatus(db)))
+	mux.HandleFunc("POST /api/auth/2fa/setup", requireAuth(db, handleTwoFactorSetup(db)))
+	mux.HandleFunc("POST /api/auth/2fa/enable", requireAuth(db, handleTwoFactorEnable(db)))
+	mux.HandleFunc("POST /api/auth/2fa/disable", requireAuth(db, handleTwoFactorDisable(db)))
+	mux.HandleFunc("POST /api/auth/2fa/recovery-codes", requireAuth(db, handleRegenerateRecoveryCodes(db)))
+	mux.HandleFunc("GET /api/auth/passkeys", requireAuth(db, handleListPasskeys(db)))
+	mux.HandleFunc("DELETE /api/auth/passkeys/{id}", requireAuth(db, handleDeletePasskey(db)))
+	mux.HandleFunc("POST /api/auth/passkeys/register/begin", requireAuth(db, handlePasskeyRegisterBegin(db)))
+	mux.HandleFunc("POST /api/auth/passkeys/register/finish", requireAuth(db, handlePasskeyRegisterFinish(db)))
 
 	// Admin endpoints
 	mux.HandleFunc("POST /api/admin/invites", requireAdmin(db, handleCreateInvite(db)))
@@ -231,18 +282,50 @@ func main() {
 	mux.HandleFunc("GET /api/admin/users", requireAdmin(db, handleListUsers(db)))
 	mux.HandleFunc("DELETE /api/admin/users/{id}", requireAdmin(db, handleDeleteUser(db)))
 	mux.HandleFunc("PUT /api/admin/users/{id}/password", requireAdmin(db, handleAdminResetPassword(db)))
+	mux.HandleFunc("PUT /api/admin/users/{id}/quota", requireAdmin(db, handleSetUserQuota(db)))
+	mux.HandleFunc("PUT /api/admin/users/{id}/models", requireAdmin(db, handleSetUserModelPolicy(db)))
+	mux.HandleFunc("PUT /api/admin/users/{id}/email", requireAdmin(db, handleSetUserEmail(db)))
+	mux.HandleFunc("GET /api/admin/users/{id}/sessions", requireAdmin(db, handleAdminListSessions(db)))
+	mux.HandleFunc("DELETE /api/admin/users/{id}/sessions", requireAdmin(db, handleAdminRevokeSessions(db)))
+	mux.HandleFunc("DELETE /api/admin/users/{id}/sessions/{sid}", requireAdmin(db, handleAdminRevokeSession(db)))
+	mux.HandleFunc("DELETE /api/admin/users/{id}/2fa", requireAdmin(db, handleAdminResetTwoFactor(db)))
+	mux.HandleFunc("GET /api/admin/usage", requireAdmin(db, handleAdminUsage(db)))
 
 	// Admin: API key management
 	mux.HandleFunc("POST /api/admin/api-keys", requireAdmin(db, handleCreateAPIKey(db)))
 	mux.HandleFunc("GET /api/admin/api-keys", requireAdmin(db, handleListAPIKeys(db)))
 	mux.HandleFunc("DELETE /api/admin/api-keys/{id}", requireAdmin(db, handleDeleteAPIKey(db)))
+	mux.HandleFunc("POST /api/admin/api-keys/{id}/rotate", requireAdmin(db, handleRotateAPIKey(db)))
+	mux.HandleFunc("PUT /api/admin/api-keys/{id}/rate-limit", requireAdmin(db, handleSetAPIKeyRateLimit(db)))
+	mux.HandleFunc("PUT /api/admin/api-keys/{id}/models", requireAdmin(db, handleSetAPIKeyModelPolicy(db)))
 
 	// Admin: Stats, Hardware, Models, Settings
-	mux.HandleFunc("GET /api/admin/stats", requireAdmin(db, handleAdminStats(db, ollama)))
+	mux.HandleFunc("GET /api/admin/presets", requireAdmin(db, handleListPresets(db)))
+	mux.HandleFunc("POST /api/admin/presets", requireAdmin(db, handleCreatePreset(db)))
+	mux.HandleFunc("PUT /api/admin/presets/{id}", requireAdmin(db, handleUpdatePreset(db)))
+	mux.HandleFunc("DELETE /api/admin/presets/{id}", requireAdmin(db, handleDeletePreset(db)))
+	mux.HandleFunc("GET /api/admin/aliases", requireAdmin(db, handleListAliases(db)))
+	mux.HandleFunc("POST /api/admin/aliases", requireAdmin(db, handleCreateAlias(db)))
+	mux.HandleFunc("PUT /api/admin/aliases/{id}", requireAdmin(db, handleUpdateAlias(db)))
+	mux.HandleFunc("DELETE /api/admin/aliases/{id}", requireAdmin(db, handleDeleteAlias(db)))
+	mux.HandleFunc("GET /api/admin/generations", requireAdmin(db, handleListGenerations()))
+	mux.HandleFunc("DELETE /api/admin/generations/{id}", requireAdmin(db, handleKillGeneration()))
+	mux.HandleFunc("GET /api/admin/stats", requireAdmin(db, handleAdminStats(db, backend)))
 	mux.HandleFunc("GET /api/admin/hardware", requireAdmin(db, handleGetHardware()))
-	mux.HandleFunc("POST /api/admin/models/pull", requireAdmin(db, handlePullModel(ollama)))
-	mux.HandleFunc("DELETE /api/admin/models", requireAdmin(db, handleDeleteModel(ollama)))
-	mux.HandleFunc("GET /api/admin/models/running", requireAdmin(db, handleListRunningModels(ollama)))
+	mux.HandleFunc("POST /api/admin/models/pull", requireAdmin(db, handlePullModel(pullJobs)))
+	mux.HandleFunc("GET /api/admin/models/jobs", requireAdmin(db, handleListModelJobs(pullJobs)))
+	mux.HandleFunc("POST /api/admin/models/jobs", requireAdmin(db, handleStartModelJob(pullJobs)))
+	mux.HandleFunc("GET /api/admin/models/jobs/{id}", requireAdmin(db, handleGetModelJob(pullJobs)))
+	mux.HandleFunc("POST /api/admin/models/jobs/{id}/cancel", requireAdmin(db, handleCancelModelJob(pullJobs)))
+	mux.HandleFunc("GET /api/admin/models/jobs/{id}/events", requireAdmin(db, handleModelJobEvents(pullJobs)))
+	mux.HandleFunc("DELETE /api/admin/models", requireAdmin(db, handleDeleteModel(backend)))
+	mux.HandleFunc("GET /api/admin/models/running", requireAdmin(db, handleListRunningModels(backend)))
+	mux.HandleFunc("POST /api/admin/models/load", requireAdmin(db, handleLoadModel(db, backend)))
+	mux.HandleFunc("POST /api/admin/models/unload", requireAdmin(db, handleUnloadModel(backend)))
+	mux.HandleFunc("GET /api/admin/models/settings", requireAdmin(db, handleListModelSettings(db)))
+	mux.HandleFunc("PUT /api/admin/models/settings", requireAdmin(db, handleSetModelSettings(db, backend)))
+	mux.HandleFunc("GET /api/admin/oidc", requireAdmin(db, handleGetOIDCConfig(db)))
+	mux.HandleFunc("PUT /api/admin/oidc", requireAdmin(db, handleSetOIDCConfig(db)))
 	mux.HandleFunc("GET /api/admin/settings", requireAdmin(db, handleGetSettings(db, tunnel)))
 	mux.HandleFunc("PUT /api/admin/settings", requireAdmin(db, handleUpdateSettings(db)))
 	mux.HandleFunc("POST /api/admin/tunnel/check", requireAdmin(db, handleTunnelCheck()))
@@ -254,9 +337,17 @@ func main() {
 	mux.HandleFunc("GET /api/admin/pause", requireAdmin(db, handleGetPause(db)))
 	mux.HandleFunc("PUT /api/admin/pause", requireAdmin(db, handleSetPause(db)))
 
-	// OpenAI-compatible API (authenticated via API key in Bearer token)
-	mux.HandleFunc("POST /v1/chat/completions", requireAPIKey(db, handleOpenAIChatCompletions(db, ollama)))
-	mux.HandleFunc("GET /v1/models", requireAPIKey(db, handleOpenAIListModels(ollama)))
+	// OpenAI- and Anthropic-compatible API (authenticated via API key in Bearer token or x-api-key)
+	mux.HandleFunc("POST /v1/chat/completions", requireAPIKey(db, requireQuota(db, handleOpenAIChatCompletions(db, backend))))
+	mux.HandleFunc("POST /v1/messages", requireAPIKey(db, requireQuota(db, handleAnthropicMessages(db, backend))))
+	mux.HandleFunc("POST /v1/completions", requireAPIKey(db, requireQuota(db, handleOpenAICompletions(db, backend))))
+	mux.HandleFunc("POST /v1/embeddings", requireAPIKey(db, requireQuota(db, handleOpenAIEmbeddings(db, backend))))
+	mux.HandleFunc("GET /v1/models", requireAPIKey(db, handleOpenAIListModels(db, backend)))
+
+	// Ollama-native API proxy (same API keys; model management is admin-only). Only with the Ollama backend.
+	if router, ok := backend.(ollamaRouter); ok {
+		mux.HandleFunc("/ollama/", requireAPIKey(db, handleOllamaProxy(db, router)))
+	}
 
 	addr := fmt.Sprintf(":%d", *port)
 	server := &http.Server{
@@ -267,7 +358,7 @@ func main() {
 	}
 
 	// --- Print the clean startup banner ---
-	printStartupBanner(db, ollama, *port, *verbose, tunnelURL)
+	printStartupBanner(db, backend, *port, *verbose, tunnelURL)
 
 	// Graceful shutdown on SIGINT/SIGTERM
 	stop := make(chan os.Signal, 1)
@@ -352,7 +443,7 @@ func serveSPA(w http.ResponseWriter, r *http.Request) {
 
 // --- Admin: Stats ---
 
-func handleAdminStats(db *DB, ollama *OllamaClient) http.HandlerFunc {
+func handleAdminStats(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var userCount, messagesToday, totalMessages, keyCount, inviteCount, activeSessions int
 
@@ -364,65 +455,30 @@ func handleAdminStats(db *DB, ollama *OllamaClient) http.HandlerFunc {
 		db.conn.QueryRow("SELECT COUNT(*) FROM sessions WHERE expires_at > CURRENT_TIMESTAMP").Scan(&activeSessions)
 
 		var modelCount int
-		models, err := ollama.ListModels()
+		models, err := backend.ListModels()
 		if err == nil {
 			modelCount = len(models)
 		}
+		running, queued := inferenceQueue.Stats()
 
 		writeJSON(w, http.StatusOK, map[string]any{
-			"users":           userCount,
-			"messages_today":  messagesToday,
-			"models":          modelCount,
-			"active_sessions": activeSessions,
-			"has_messages":    totalMessages > 0,
-			"has_api_keys":    keyCount > 0,
-			"has_invites":     inviteCount > 0,
-			"has_models":      modelCount > 0,
+			"users":            userCount,
+			"messages_today":   messagesToday,
+			"models":           modelCount,
+			"active_sessions":  activeSessions,
+			"has_messages":     totalMessages > 0,
+			"has_api_keys":     keyCount > 0,
+			"has_invites":      inviteCount > 0,
+			"has_models":       modelCount > 0,
+			"inference_active": running,
+			"inference_queued": queued,
 		})
 	}
 }
 
 // --- Admin: Model management ---
 
-func handlePullModel(ollama *OllamaClient) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var req struct {
-			Name string `json:"name"`
-		}
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model name required"})
-			return
-		}
-
-		flusher, ok := w.(http.Flusher)
-		if !ok {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
-			return
-		}
-
-		w.Header().Set("Content-Type", "text/event-stream")
-		w.Header().Set("Cache-Control", "no-cache")
-		w.Header().Set("Connection", "keep-alive")
-
-		err := ollama.PullModelStream(req.Name, func(line []byte) error {
-			fmt.Fprintf(w, "data: %s\n\n", line)
-			flusher.Flush()
-			return nil
-		})
-
-		if err != nil {
-			errJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
-			fmt.Fprintf(w, "data: %s\n\n", errJSON)
-			flusher.Flush()
-			return
-		}
-
-		fmt.Fprintf(w, "data: [DONE]\n\n")
-		flusher.Flush()
-	}
-}
-
-func handleDeleteModel(ollama *OllamaClient) http.HandlerFunc {
+func handleDeleteModel(backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
 			Name string `json:"name"`
@@ -432,7 +488,11 @@ func handleDeleteModel(ollama *OllamaClient) http.HandlerFunc {
 			return
 		}
 
-		if err := ollama.DeleteModel(req.Name); err != nil {
+		if err := backend.DeleteModel(req.Name); err != nil {
+			if errors.Is(err, errBackendUnsupported) {
+				writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "model management is " + err.Error()})
+				return
+			}
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("failed to delete model: %v", err)})
 			return
 		}
@@ -440,9 +500,9 @@ func handleDeleteModel(ollama *OllamaClient) http.HandlerFunc {
 	}
 }
 
-func handleListRunningModels(ollama *OllamaClient) http.HandlerFunc {
+func handleListRunningModels(backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		models, err := ollama.ListRunningModels()
+		models, err := backend.ListRunningModels()
 		if err != nil {
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("failed to list running models: %v", err)})
 			return
@@ -462,10 +522,11 @@ func handleGetSettings(db *DB, tunnel TunnelProvider) http.HandlerFunc {
 		tunnelURL, _ := db.GetConfig("tunnel_url")
 		tunnelSubdomain, _ := db.GetConfig("tunnel_subdomain")
 		writeJSON(w, http.StatusOK, map[string]any{
-			"server_name":      serverName,
-			"tunnel_url":       tunnelURL,
-			"tunnel_mode":      tunnel.Mode(),
-			"tunnel_subdomain": tunnelSubdomain,
+			"server_name":       serverName,
+			"tunnel_url":        tunnelURL,
+			"tunnel_mode":       tunnel.Mode(),
+			"tunnel_subdomain":  tunnelSubdomain,
+			"require_admin_2fa": adminTwoFactorRequired(db),
 		})
 	}
 }
@@ -473,19 +534,27 @@ func handleGetSettings(db *DB, tunnel TunnelProvider) http.HandlerFunc {
 func handleUpdateSettings(db *DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req struct {
-			ServerName *string `json:"server_name"`
-			TunnelURL  *string `json:"tunnel_url"`
+			ServerName      *string `json:"server_name"`
+			TunnelURL       *string `json:"tunnel_url"`
+			RequireAdmin2FA *bool   `json:"require_admin_2fa"`
 		}
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 			return
 		}
+		if req.RequireAdmin2FA != nil && *req.RequireAdmin2FA && !UserFromContext(r.Context()).TwoFactorEnabled {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "enable two-factor authentication on your own account first"})
+			return
+		}
 		if req.ServerName != nil {
 			db.SetConfig("server_name", *req.ServerName)
 		}
 		if req.TunnelURL != nil {
 			db.SetConfig("tunnel_url", *req.TunnelURL)
 		}
+		if req.RequireAdmin2FA != nil {
+			db.SetConfig("require_admin_2fa", fmt.Sprint(*req.RequireAdmin2FA))
+		}
 		writeJSON(w, http.StatusOK, map[string]string{"status": "updated"})
 	}
 }
@@ -525,12 +594,7 @@ func handleChangePassword(db *DB) http.HandlerFunc {
 		}
 
 		// Invalidate all other sessions so stolen sessions can't be reused
-		cookie, _ := r.Cookie("session")
-		if cookie != nil {
-			db.conn.Exec("DELETE FROM sessions WHERE user_id = ? AND id != ?", user.ID, cookie.Value)
-		} else {
-			db.conn.Exec("DELETE FROM sessions WHERE user_id = ?", user.ID)
-		}
+		db.DeleteOtherSessions(user.ID, currentSessionToken(r))
 
 		writeJSON(w, http.StatusOK, map[string]string{"status": "password updated"})
 	}
@@ -599,16 +663,18 @@ func handleResetServer(db *DB) http.HandlerFunc {
 			return
 		}
 
-		// Reset the rate limiter map on server wipe
+		// Reset the rate limiters on server wipe
 		loginAttempts = sync.Map{}
+		apiKeyLimiter.Reset()
+		activeGenerations.StopAll()
 
 		writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
 	}
 }
 
-func handleListModels(ollama *OllamaClient) http.HandlerFunc {
+func handleListModels(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		models, err := ollama.ListModels()
+		models, err := listAllModels(db, backend)
 		if err != nil {
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("failed to list models: %v", err)})
 			return
@@ -616,21 +682,22 @@ func handleListModels(ollama *OllamaClient) http.HandlerFunc {
 
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]any{
-			"models": models,
+			"models": permittedModels(r.Context(), models),
 		})
 	}
 }
 
 // ConversationChatRequest extends ChatRequest with an optional conversation ID.
 type ConversationChatRequest struct {
-	Model          string `json:"model"`
-	Message        string `json:"message"`
-	ConversationID *int   `json:"conversation_id,omitempty"`
-	Encrypted      bool   `json:"encrypted"`
-	IV             string `json:"iv"`
+	Model          string   `json:"model"`
+	Message        string   `json:"message"`
+	Images         []string `json:"images,omitempty"` // base64 or data URLs, stored encrypted with the message
+	ConversationID *int     `json:"conversation_id,omitempty"`
+	Encrypted      bool     `json:"encrypted"`
+	IV             string   `json:"iv"`
 }
 
-func handleChatWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
+func handleChatWithHistory(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := UserFromContext(r.Context())
 		var req ConversationChatRequest
@@ -638,10 +705,28 @@ func handleChatWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 			return
 		}
-		if req.Model == "" || req.Message == "" {
+		if req.Model == "" || (req.Message == "" && len(req.Images) == 0) {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model and message are required"})
 			return
 		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("you don't have access to model %q", req.Model)})
+			return
+		}
+		targets, err := resolveChatTargets(r.Context(), db, req.Model)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to resolve model"})
+			return
+		}
+		if len(targets) == 0 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("you don't have access to model %q", req.Model)})
+			return
+		}
+		images, err := decodeImageList(req.Images)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
 
 		if req.Encrypted && len(user.EncryptionKey) == 32 {
 			ivBytes, err := base64.StdEncoding.DecodeString(req.IV)
@@ -656,6 +741,14 @@ func handleChatWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
 			}
 		}
 
+		ticket, err := inferenceQueue.Enqueue(r.Context(), user.ID)
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server is busy: " + err.Error()})
+			return
+		}
+		defer ticket.Release()
+
 		convo, messages, err := prepareChat(db, user, &req)
 		if err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
@@ -663,18 +756,28 @@ func handleChatWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
 		}
 
 		// Add current message to history
-		messages = append(messages, ChatMessage{Role: "user", Content: req.Message})
+		messages = append(messages, ChatMessage{Role: "user", Content: req.Message, Images: images})
 
-		resp, err := ollama.Chat(req.Model, messages, nil)
+		if err := ticket.Wait(nil); err != nil {
+			writeQueueRetryAfter(w)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+			return
+		}
+
+		start := time.Now()
+		resp, served, err := targets.Chat(r.Context(), backend, ChatRequest{Messages: messages})
 		if err != nil {
-			log.Printf("Ollama error: %v", err)
+			recordUsage(db, r, served, start, 0, 0, err)
+			log.Printf("Inference error: %v", err)
 			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("inference failed: %v", err)})
 			return
 		}
+		resp.Model = served
+		recordUsage(db, r, served, start, resp.PromptTokens, resp.CompletionTokens, nil)
 
 		// Save both messages
-		db.AddMessage(convo.ID, "user", req.Message, nil, user.EncryptionKey)
-		db.AddMessage(convo.ID, "assistant", resp.Message.Content, nil, user.EncryptionKey)
+		db.AddMessageWithImages(convo.ID, "user", req.Message, images, nil, user.EncryptionKey)
+		db.AddMessage(convo.ID, "assistant", resp.Message.Content, &resp.CompletionTokens, user.EncryptionKey)
 
 		if req.Encrypted && len(user.EncryptionKey) == 32 {
 			cipherBytes, ivBytes, err := EncryptAESGCM(user.EncryptionKey, []byte(resp.Message.Content))
@@ -693,7 +796,7 @@ func handleChatWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
 	}
 }
 
-func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc {
+func handleChatStreamWithHistory(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := UserFromContext(r.Context())
 		var req ConversationChatRequest
@@ -701,10 +804,28 @@ func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
 			return
 		}
-		if req.Model == "" || req.Message == "" {
+		if req.Model == "" || (req.Message == "" && len(req.Images) == 0) {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model and message are required"})
 			return
 		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("you don't have access to model %q", req.Model)})
+			return
+		}
+		targets, err := resolveChatTargets(r.Context(), db, req.Model)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to resolve model"})
+			return
+		}
+		if len(targets) == 0 {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("you don't have access to model %q", req.Model)})
+			return
+		}
+		images, err := decodeImageList(req.Images)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
 
 		if req.Encrypted && len(user.EncryptionKey) == 32 {
 			ivBytes, err := base64.StdEncoding.DecodeString(req.IV)
@@ -719,13 +840,32 @@ func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc
 			}
 		}
 
+		// Cancelled by the client disconnecting or by a stop request
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+
+		ticket, err := inferenceQueue.Enqueue(ctx, user.ID)
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server is busy: " + err.Error()})
+			return
+		}
+		defer ticket.Release()
+
 		convo, messages, err := prepareChat(db, user, &req)
 		if err != nil {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 			return
 		}
 
-		messages = append(messages, ChatMessage{Role: "user", Content: req.Message})
+		messages = append(messages, ChatMessage{Role: "user", Content: req.Message, Images: images})
+
+		gen := activeGenerations.Register(convo.ID, user, req.Model, cancel)
+		if gen == nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "a response is already being generated for this conversation"})
+			return
+		}
+		defer activeGenerations.Finish(gen)
 
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -741,12 +881,34 @@ func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc
 		fmt.Fprintf(w, "data: {\"conversation_id\":%d}\n\n", convo.ID)
 		flusher.Flush()
 
+		// Wait for a free inference slot, reporting queue position while waiting
+		err = ticket.Wait(func(position int) {
+			fmt.Fprintf(w, "data: {\"queued\":%d}\n\n", position)
+			flusher.Flush()
+		})
+		if err != nil && gen.stopped.Load() {
+			fmt.Fprint(w, "data: {\"stopped\":true}\n\n")
+			flusher.Flush()
+			return
+		}
+		if err != nil {
+			errJSON, _ := json.Marshal(map[string]string{"error": err.Error()})
+			fmt.Fprintf(w, "data: %s\n\n", errJSON)
+			flusher.Flush()
+			return
+		}
+
 		// Save user message
-		db.AddMessage(convo.ID, "user", req.Message, nil, user.EncryptionKey)
+		db.AddMessageWithImages(convo.ID, "user", req.Message, images, nil, user.EncryptionKey)
 
 		var fullResponse string
-		err = ollama.ChatStream(req.Model, messages, nil, func(chunk StreamChunk) error {
+		var promptTokens, completionTokens int
+		start := time.Now()
+		served, err := targets.ChatStream(ctx, backend, ChatRequest{Messages: messages}, func(_ string, chunk StreamChunk) error {
 			fullResponse += chunk.Content
+			if chunk.Done {
+				promptTokens, completionTokens = chunk.PromptTokens, chunk.CompletionTokens
+			}
 
 			if req.Encrypted && len(user.EncryptionKey) == 32 {
 				cipherBytes, ivBytes, err := EncryptAESGCM(user.EncryptionKey, []byte(chunk.Content))
@@ -763,6 +925,30 @@ func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc
 			return nil
 		})
 
+		stopped := err != nil && gen.stopped.Load()
+		if stopped {
+			recordUsage(db, r, served, start, promptTokens, completionTokens, nil)
+		} else {
+			recordUsage(db, r, served, start, promptTokens, completionTokens, err)
+		}
+		if err != nil && ctx.Err() != nil {
+			// Stopped on request, or the client went away mid-generation; either
+			// way Ollama has stopped too. Keep what was produced so the
+			// conversation shows where it stopped.
+			event := map[string]any{"stopped": true}
+			if fullResponse != "" {
+				if msg, err := db.AddMessage(convo.ID, "assistant", fullResponse, nil, user.EncryptionKey); err == nil {
+					db.MarkMessageInterrupted(msg.ID)
+					event["message_id"] = msg.ID
+				}
+			}
+			if stopped && r.Context().Err() == nil {
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "data: %s\n\n", data)
+				flusher.Flush()
+			}
+			return
+		}
 		if err != nil {
 			log.Printf("Stream error: %v", err)
 			fmt.Fprintf(w, "data: {\"error\":\"%s\"}\n\n", err)
@@ -771,7 +957,7 @@ func handleChatStreamWithHistory(db *DB, ollama *OllamaClient) http.HandlerFunc
 		}
 
 		// Save assistant response
-		db.AddMessage(convo.ID, "assistant", fullResponse, nil, user.EncryptionKey)
+		db.AddMessage(convo.ID, "assistant", fullResponse, &completionTokens, user.EncryptionKey)
 
 		fmt.Fprintf(w, "data: [DONE]\n\n")
 		flusher.Flush()
@@ -799,7 +985,7 @@ func prepareChat(db *DB, user *User, req *ConversationChatRequest) (*Conversatio
 			return nil, nil, fmt.Errorf("loading messages: %v", err)
 		}
 		for _, m := range stored {
-			chatMessages = append(chatMessages, ChatMessage{Role: m.Role, Content: m.Content})
+			chatMessages = append(chatMessages, ChatMessage{Role: m.Role, Content: m.Content, Images: m.Images})
 		}
 	} else {
 		// Create new conversation, use first ~50 chars of message as title
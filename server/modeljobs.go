@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ModelJob is a model download that runs on the server, independent of the
+// admin connection that started it.
+type ModelJob struct {
+	ID         int        `json:"id"`
+	Model      string     `json:"model"`
+	Status     string     `json:"status"`            // queued, running, completed, failed or cancelled
+	Message    string     `json:"message,omitempty"` // latest progress status from the backend, e.g. "pulling manifest"
+	Completed  int64      `json:"completed"`         // bytes of the layer being downloaded
+	Total      int64      `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	CreatedBy  int        `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+func (j *ModelJob) finished() bool {
+	return j.Status == jobCompleted || j.Status == jobFailed || j.Status == jobCancelled
+}
+
+// modelJobSaveInterval throttles how often download progress is written to the database.
+const modelJobSaveInterval = time.Second
+
+// liveModelJob is a queued or running job. Watchers wait on changed, which
+// is closed and replaced on every update; seq numbers the updates.
+type liveModelJob struct {
+	mu      sync.Mutex
+	job     ModelJob
+	seq     int
+	changed chan struct{}
+	saved   time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the final state is saved
+}
+
+// snapshot returns the job's current state, its update number, and a
+// channel that is closed on the next update.
+func (l *liveModelJob) snapshot() (ModelJob, int, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.job, l.seq, l.changed
+}
+
+// update applies fn to the job and wakes up watchers. It returns the new
+// state and whether it is due to be saved.
+func (l *liveModelJob) update(fn func(*ModelJob)) (ModelJob, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := l.job.Status
+	fn(&l.job)
+	l.seq++
+	close(l.changed)
+	l.changed = make(chan struct{})
+
+	save := l.job.Status != prev || time.Since(l.saved) >= modelJobSaveInterval
+	if save {
+		l.saved = time.Now()
+	}
+	return l.job, save
+}
+
+// PullJobs runs model downloads in the background, at most limit at a time.
+type PullJobs struct {
+	db      *DB
+	backend Backend
+	ctx     context.Context // parent of every job; cancelled on shutdown
+	slots   chan struct{}   // nil = unlimited
+
+	mu   sync.Mutex
+	live map[int]*liveModelJob
+}
+
+// NewPullJobs creates the job runner. Jobs left queued or running by a
+// previous process are marked failed, since their downloads are gone.
+func NewPullJobs(ctx context.Context, db *DB, backend Backend, limit int) *PullJobs {
+	if err := db.FailInterruptedModelJobs(); err != nil {
+		log.Printf("Model jobs: %v", err)
+	}
+	p := &PullJobs{db: db, backend: backend, ctx: ctx, live: make(map[int]*liveModelJob)}
+	if limit > 0 {
+		p.slots = make(chan struct{}, limit)
+	}
+	return p
+}
+
+// Start queues a download of model. If the model is already being pulled,
+// the existing job is returned instead and started is false.
+func (p *PullJobs) Start(model string, userID int) (job *ModelJob, started bool, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, l := range p.live {
+		if j, _, _ := l.snapshot(); normalizeModelName(j.Model) == normalizeModelName(model) {
+			return &j, false, nil
+		}
+	}
+
+	job, err = p.db.CreateModelJob(model, userID)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	l := &liveModelJob{job: *job, seq: 1, changed: make(chan struct{}), cancel: cancel, done: make(chan struct{})}
+	p.live[job.ID] = l
+	go p.run(ctx, l)
+	return job, true, nil
+}
+
+func (p *PullJobs) run(ctx context.Context, l *liveModelJob) {
+	id := l.job.ID
+	defer func() {
+		p.mu.Lock()
+		delete(p.live, id)
+		p.mu.Unlock()
+		l.cancel()
+		close(l.done)
+	}()
+
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+		case <-ctx.Done():
+			p.finish(l, ctx.Err())
+			return
+		}
+	}
+
+	job, _ := l.update(func(j *ModelJob) {
+		now := time.Now().UTC()
+		j.Status = jobRunning
+		j.StartedAt = &now
+	})
+	p.save(job)
+
+	err := p.backend.PullModelStream(ctx, job.Model, func(line []byte) error {
+		var progress struct {
+			Status    string `json:"status"`
+			Completed int64  `json:"completed"`
+			Total     int64  `json:"total"`
+			Error     string `json:"error"`
+		}
+		if err := json.Unmarshal(line, &progress); err != nil {
+			return nil
+		}
+		if progress.Error != "" {
+			return errors.New(progress.Error)
+		}
+		job, save := l.update(func(j *ModelJob) {
+			j.Message = progress.Status
+			if progress.Total > 0 { // status-only lines keep the last byte counts
+				j.Completed = progress.Completed
+				j.Total = progress.Total
+			}
+		})
+		if save {
+			p.save(job)
+		}
+		return nil
+	})
+	if err == nil {
+		err = ctx.Err()
+	}
+	p.finish(l, err)
+}
+
+// finish records the outcome of a job: err is nil on success and
+// context.Canceled if the job was cancelled.
+func (p *PullJobs) finish(l *liveModelJob, err error) {
+	job, _ := l.update(func(j *ModelJob) {
+		now := time.Now().UTC()
+		j.FinishedAt = &now
+		switch {
+		case err == nil:
+			j.Status = jobCompleted
+		case errors.Is(err, context.Canceled):
+			j.Status = jobCancelled
+		default:
+			j.Status = jobFailed
+			j.Error = err.Error()
+		}
+	})
+	p.save(job)
+	if job.Status == jobFailed {
+		log.Printf("Model jobs: pulling %s failed: %s", job.Model, job.Error)
+	}
+}
+
+func (p *PullJobs) save(job ModelJob) {
+	if err := p.db.UpdateModelJob(&job); err != nil {
+		log.Printf("Model jobs: saving job %d: %v", job.ID, err)
+	}
+}
+
+func (p *PullJobs) watch(id int) *liveModelJob {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.live[id]
+}
+
+// Get returns a job's current state, or nil if there is no such job.
+func (p *PullJobs) Get(id int) (*ModelJob, error) {
+	if l := p.watch(id); l != nil {
+		job, _, _ := l.snapshot()
+		return &job, nil
+	}
+	return p.db.GetModelJob(id)
+}
+
+// List returns recent jobs, newest first, with live progress for active ones.
+func (p *PullJobs) List() ([]ModelJob, error) {
+	jobs, err := p.db.ListModelJobs(100)
+	if err != nil {
+		return nil, err
+	}
+	for i := range jobs {
+		if l := p.watch(jobs[i].ID); l != nil {
+			jobs[i], _, _ = l.snapshot()
+		}
+	}
+	return jobs, nil
+}
+
+// Cancel stops a queued or running job and waits briefly for it to wind
+// down. It returns false if the job is not active.
+func (p *PullJobs) Cancel(id int) bool {
+	l := p.watch(id)
+	if l == nil {
+		return false
+	}
+	l.cancel()
+	select {
+	case <-l.done:
+	case <-time.After(stopWaitTimeout):
+	}
+	return true
+}
+
+// --- Database methods ---
+
+const modelJobColumns = `id, model, status, message, completed, total, error, created_by, created_at, started_at, finished_at`
+
+func scanModelJob(row interface{ Scan(...any) error }) (*ModelJob, error) {
+	var j ModelJob
+	var message, jobErr sql.NullString
+	var createdBy sql.NullInt64
+	if err := row.Scan(&j.ID, &j.Model, &j.Status, &message, &j.Completed, &j.Total, &jobErr,
+		&createdBy, &j.CreatedAt, &j.StartedAt, &j.FinishedAt); err != nil {
+		return nil, err
+	}
+	j.Message = message.String
+	j.Error = jobErr.String
+	j.CreatedBy = int(createdBy.Int64)
+	return &j, nil
+}
+
+// CreateModelJob records a new queued pull of model.
+func (db *DB) CreateModelJob(model string, createdBy int) (*ModelJob, error) {
+	result, err := db.conn.Exec(`
+		INSERT INTO model_jobs (model, status, created_by) VALUES (?, ?, ?)
+	`, model, jobQueued, createdBy)
+	if err != nil {
+		return nil, fmt.Errorf("inserting model job: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	return &ModelJob{
+		ID:        int(id),
+		Model:     model,
+		Status:    jobQueued,
+		CreatedBy: createdBy,
+		CreatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// UpdateModelJob saves a job's status and progress.
+func (db *DB) UpdateModelJob(j *ModelJob) error {
+	_, err := db.conn.Exec(`
+		UPDATE model_jobs
+		SET status = ?, message = ?, completed = ?, total = ?, error = ?, started_at = ?, finished_at = ?
+		WHERE id = ?
+	`, j.Status, j.Message, j.Completed, j.Total, j.Error, j.StartedAt, j.FinishedAt, j.ID)
+	return err
+}
+
+// GetModelJob returns a job by ID, or nil if there is no such job.
+func (db *DB) GetModelJob(id int) (*ModelJob, error) {
+	j, err := scanModelJob(db.conn.QueryRow(`SELECT `+modelJobColumns+` FROM model_jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return j, err
+}
+
+// ListModelJobs returns the most recent jobs, newest first.
+func (db *DB) ListModelJobs(limit int) ([]ModelJob, error) {
+	rows, err := db.conn.Query(`SELECT `+modelJobColumns+` FROM model_jobs ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs []ModelJob
+	for rows.Next() {
+		j, err := scanModelJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *j)
+	}
+	return jobs, rows.Err()
+}
+
+// FailInterruptedModelJobs marks jobs that were still active when the server stopped as failed.
+func (db *DB) FailInterruptedModelJobs() error {
+	_, err := db.conn.Exec(`
+		UPDATE model_jobs SET status = ?, error = 'interrupted by a server restart', finished_at = CURRENT_TIMESTAMP
+		WHERE status IN (?, ?)
+	`, jobFailed, jobQueued, jobRunning)
+	return err
+}
+
+// --- HTTP handlers ---
+
+// handlePullModel handles POST /api/admin/models/pull. It starts a pull job
+// and streams its progress in the shape of the backend's own progress lines,
+// as this endpoint always has; disconnecting does not stop the download.
+func handlePullModel(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model name required"})
+			return
+		}
+
+		job, _, err := jobs.Start(req.Name, UserFromContext(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start pull"})
+			return
+		}
+		streamModelJob(w, r, jobs, job.ID, 0, pullProgressEvent)
+	}
+}
+
+// handleStartModelJob handles POST /api/admin/models/jobs
+func handleStartModelJob(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Model string `json:"model"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Model == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "model is required"})
+			return
+		}
+
+		job, started, err := jobs.Start(req.Model, UserFromContext(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start pull"})
+			return
+		}
+		status := http.StatusAccepted
+		if !started {
+			status = http.StatusOK
+		}
+		writeJSON(w, status, map[string]any{"job": job})
+	}
+}
+
+// handleListModelJobs handles GET /api/admin/models/jobs
+func handleListModelJobs(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		list, err := jobs.List()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list model jobs"})
+			return
+		}
+		if list == nil {
+			list = []ModelJob{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"jobs": list})
+	}
+}
+
+// handleGetModelJob handles GET /api/admin/models/jobs/{id}
+func handleGetModelJob(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid job ID"})
+			return
+		}
+
+		job, err := jobs.Get(id)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load job"})
+			return
+		}
+		if job == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"job": job})
+	}
+}
+
+// handleCancelModelJob handles POST /api/admin/models/jobs/{id}/cancel
+func handleCancelModelJob(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid job ID"})
+			return
+		}
+
+		if !jobs.Cancel(id) {
+			job, err := jobs.Get(id)
+			if err != nil || job == nil {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+				return
+			}
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "job has already " + job.Status})
+			return
+		}
+		job, err := jobs.Get(id)
+		if err != nil || job == nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "job cancelled but could not be reloaded"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"job": job})
+	}
+}
+
+// handleModelJobEvents handles GET /api/admin/models/jobs/{id}/events, an
+// SSE feed of the job's state. Each event carries an ID, so a reconnecting
+// client (Last-Event-ID) only receives newer updates.
+func handleModelJobEvents(jobs *PullJobs) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid job ID"})
+			return
+		}
+		lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+
+		job, err := jobs.Get(id)
+		if err != nil || job == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "job not found"})
+			return
+		}
+		streamModelJob(w, r, jobs, id, lastID, func(job *ModelJob) any { return job })
+	}
+}
+
+// pullProgressEvent renders a job as a backend progress line:
+// {status, completed, total} while pulling, or {error} if it didn't succeed.
+func pullProgressEvent(job *ModelJob) any {
+	switch job.Status {
+	case jobFailed:
+		return map[string]string{"error": job.Error}
+	case jobCancelled:
+		return map[string]string{"error": "pull cancelled"}
+	}
+	status := job.Message
+	if status == "" {
+		status = job.Status // queued, or running before the backend reports anything
+	}
+	event := map[string]any{"status": status}
+	if job.Total > 0 {
+		event["completed"] = job.Completed
+		event["total"] = job.Total
+	}
+	return event
+}
+
+// streamModelJob sends the job's state as SSE events, rendered by event,
+// until it finishes or the client goes away, skipping updates up to lastID.
+// The feed ends with [DONE].
+func streamModelJob(w http.ResponseWriter, r *http.Request, jobs *PullJobs, id, lastID int, event func(*ModelJob) any) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "streaming not supported"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush() // a resumed feed may have nothing to send until the next update
+
+	l := jobs.watch(id)
+	if l == nil {
+		// Already finished: send the final state once
+		if job, err := jobs.Get(id); err == nil && job != nil {
+			data, _ := json.Marshal(event(job))
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		fmt.Fprintf(w, "data: [DONE]\n\n")
+		flusher.Flush()
+		return
+	}
+
+	for {
+		job, seq, changed := l.snapshot()
+		if seq > lastID {
+			data, _ := json.Marshal(event(&job))
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", seq, data)
+			flusher.Flush()
+			lastID = seq
+		}
+		if job.finished() {
+			fmt.Fprintf(w, "data: [DONE]\n\n")
+			flusher.Flush()
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
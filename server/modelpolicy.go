@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// ModelPolicy restricts which models a user or API key may call. Patterns
+// are shell-style globs ("llama3.3:*", "*:70b"); a pattern without a tag
+// matches every tag of that model. A model is permitted when it matches no
+// Deny pattern and, if Allow is non-empty, at least one Allow pattern.
+type ModelPolicy struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+// Permits reports whether the policy lets model be used. A nil policy permits everything.
+func (p *ModelPolicy) Permits(model string) bool {
+	if p == nil {
+		return true
+	}
+	for _, pattern := range p.Deny {
+		if matchModelPattern(pattern, model) {
+			return false
+		}
+	}
+	if len(p.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range p.Allow {
+		if matchModelPattern(pattern, model) {
+			return true
+		}
+	}
+	return false
+}
+
+// validate rejects malformed glob patterns.
+func (p *ModelPolicy) validate() error {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("model patterns must not be empty")
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid model pattern %q", pattern)
+		}
+	}
+	return nil
+}
+
+// isEmpty reports whether the policy places no restriction at all.
+func (p *ModelPolicy) isEmpty() bool {
+	return p == nil || (len(p.Allow) == 0 && len(p.Deny) == 0)
+}
+
+func matchModelPattern(pattern, model string) bool {
+	name := normalizeModelName(model)
+	if !strings.Contains(pattern, ":") {
+		name, _, _ = strings.Cut(name, ":")
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// encodeModelPolicy converts a policy to its model_policy column value (NULL when unrestricted).
+func encodeModelPolicy(p *ModelPolicy) any {
+	if p.isEmpty() {
+		return nil
+	}
+	b, _ := json.Marshal(p)
+	return string(b)
+}
+
+// decodeModelPolicy parses a model_policy column value.
+func decodeModelPolicy(s sql.NullString) *ModelPolicy {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	var p ModelPolicy
+	if err := json.Unmarshal([]byte(s.String), &p); err != nil {
+		return nil
+	}
+	return &p
+}
+
+// modelPermitted reports whether the request's user and API key (if any) may use model.
+func modelPermitted(ctx context.Context, model string) bool {
+	if user := UserFromContext(ctx); user != nil && !user.ModelPolicy.Permits(model) {
+		return false
+	}
+	if key := APIKeyFromContext(ctx); key != nil && !key.ModelPolicy.Permits(model) {
+		return false
+	}
+	return true
+}
+
+// permittedModels filters a model list down to what the request may use.
+func permittedModels(ctx context.Context, models []Model) []Model {
+	out := make([]Model, 0, len(models))
+	for _, m := range models {
+		if modelPermitted(ctx, m.Name) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// --- Database methods ---
+
+// SetUserModelPolicy replaces a user's model policy (nil = unrestricted).
+func (db *DB) SetUserModelPolicy(userID int, p *ModelPolicy) error {
+	result, err := db.conn.Exec(`UPDATE users SET model_policy = ? WHERE id = ?`, encodeModelPolicy(p), userID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// SetAPIKeyModelPolicy replaces an API key's model policy (nil = unrestricted).
+func (db *DB) SetAPIKeyModelPolicy(keyID int, p *ModelPolicy) error {
+	result, err := db.conn.Exec(`UPDATE api_keys SET model_policy = ? WHERE id = ?`, encodeModelPolicy(p), keyID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// --- HTTP handlers ---
+
+// handleSetUserModelPolicy handles PUT /api/admin/users/{id}/models
+func handleSetUserModelPolicy(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+			return
+		}
+
+		var req ModelPolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := db.SetUserModelPolicy(id, &req); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update model policy"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"user_id": id, "model_policy": req})
+	}
+}
+
+// handleSetAPIKeyModelPolicy handles PUT /api/admin/api-keys/{id}/models
+func handleSetAPIKeyModelPolicy(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid key ID"})
+			return
+		}
+
+		var req ModelPolicy
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := req.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := db.SetAPIKeyModelPolicy(id, &req); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update model policy"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "model_policy": req})
+	}
+}
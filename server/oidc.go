@@ -0,0 +1,812 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig configures single sign-on through an OpenID Connect provider.
+// It is stored as JSON under the "oidc" server config key.
+type OIDCConfig struct {
+	Issuer       string `json:"issuer"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	RedirectURL  string `json:"redirect_url,omitempty"` // default: <this server>/api/auth/oidc/callback
+	Scopes       string `json:"scopes,omitempty"`       // default: "openid profile email"
+	GroupsClaim  string `json:"groups_claim,omitempty"` // default: "groups"
+	AdminGroup   string `json:"admin_group,omitempty"`  // members are admins, others are not; "" leaves is_admin alone
+}
+
+const (
+	oidcStateTTL     = 10 * time.Minute
+	oidcDiscoveryTTL = time.Hour
+	oidcClockSkew    = 2 * time.Minute
+	oidcJWKSMinWait  = time.Minute // between JWKS refetches for unknown key IDs
+)
+
+// oidcHTTPClient makes the server's calls to the identity provider.
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// getOIDCConfig returns the configured provider, or nil if SSO is off.
+func getOIDCConfig(db *DB) (*OIDCConfig, error) {
+	raw, err := db.GetConfig("oidc")
+	if err != nil || raw == "" {
+		return nil, err
+	}
+	var cfg OIDCConfig
+	if err := json.Unmarshal([]byte(raw), &cfg); err != nil {
+		return nil, fmt.Errorf("decoding OIDC config: %w", err)
+	}
+	return &cfg, nil
+}
+
+func (c *OIDCConfig) redirectURL(r *http.Request) string {
+	if c.RedirectURL != "" {
+		return c.RedirectURL
+	}
+	return relyingPartyFor(r).Origin + "/api/auth/oidc/callback"
+}
+
+func (c *OIDCConfig) scopes() string {
+	if c.Scopes != "" {
+		return c.Scopes
+	}
+	return "openid profile email"
+}
+
+func (c *OIDCConfig) groupsClaim() string {
+	if c.GroupsClaim != "" {
+		return c.GroupsClaim
+	}
+	return "groups"
+}
+
+// --- Provider discovery and keys ---
+
+// oidcProvider is an identity provider's discovery document and signing keys.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	discovered time.Time
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey // by key ID
+	keysFetched time.Time
+}
+
+type oidcProviderCache struct {
+	mu        sync.Mutex
+	providers map[string]*oidcProvider // by issuer
+}
+
+var oidcProviders = &oidcProviderCache{providers: make(map[string]*oidcProvider)}
+
+// get returns the provider for an issuer, fetching its discovery document
+// when it is not cached or has gone stale.
+func (c *oidcProviderCache) get(ctx context.Context, issuer string) (*oidcProvider, error) {
+	c.mu.Lock()
+	p, ok := c.providers[issuer]
+	c.mu.Unlock()
+	if ok && time.Since(p.discovered) < oidcDiscoveryTTL {
+		return p, nil
+	}
+
+	p = &oidcProvider{}
+	if err := oidcGetJSON(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, fmt.Errorf("discovery: %w", err)
+	}
+	if p.Issuer != issuer {
+		return nil, fmt.Errorf("discovery: provider reports issuer %q, expected %q", p.Issuer, issuer)
+	}
+	if p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" || p.JWKSURI == "" {
+		return nil, errors.New("discovery: document is missing required endpoints")
+	}
+	p.discovered = time.Now()
+
+	c.mu.Lock()
+	c.providers[issuer] = p
+	c.mu.Unlock()
+	return p, nil
+}
+
+func oidcGetJSON(ctx context.Context, url string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", url, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// key returns the signing key with the given ID, refetching the JWKS when
+// the ID is unknown (the provider may have rotated keys).
+func (p *oidcProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if k, ok := p.lookupKey(kid); ok {
+		return k, nil
+	}
+	if p.keys != nil && time.Since(p.keysFetched) < oidcJWKSMinWait {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := oidcGetJSON(ctx, p.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching JWKS: %w", err)
+	}
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysFetched = time.Now()
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch k.Kty {
+		case "RSA":
+			n, err1 := decodeBase64URL(k.N)
+			e, err2 := decodeBase64URL(k.E)
+			if err1 != nil || err2 != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			exp := 0
+			for _, b := range e {
+				exp = exp<<8 | int(b)
+			}
+			p.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exp}
+		case "EC":
+			x, err1 := decodeBase64URL(k.X)
+			y, err2 := decodeBase64URL(k.Y)
+			if k.Crv != "P-256" || err1 != nil || err2 != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				p.keys[k.Kid] = pub
+			}
+		}
+	}
+	if k, ok := p.lookupKey(kid); ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// lookupKey finds a key by ID. A token without a key ID matches the only key.
+func (p *oidcProvider) lookupKey(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(p.keys) == 1 {
+		for _, k := range p.keys {
+			return k, true
+		}
+	}
+	k, ok := p.keys[kid]
+	return k, ok
+}
+
+// --- ID tokens ---
+
+// audience is the aud claim, which may be a string or an array.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = audience{s}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(b, &list); err != nil {
+		return err
+	}
+	*a = list
+	return nil
+}
+
+type idTokenClaims struct {
+	Issuer            string   `json:"iss"`
+	Subject           string   `json:"sub"`
+	Audience          audience `json:"aud"`
+	AuthorizedParty   string   `json:"azp"`
+	Expiry            int64    `json:"exp"`
+	IssuedAt          int64    `json:"iat"`
+	Nonce             string   `json:"nonce"`
+	Email             string   `json:"email"`
+	EmailVerified     any      `json:"email_verified"` // some providers send "true"
+	PreferredUsername string   `json:"preferred_username"`
+	Name              string   `json:"name"`
+
+	raw map[string]any
+}
+
+func (c *idTokenClaims) emailVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+// groups returns the string values of a claim holding a list of groups.
+func (c *idTokenClaims) groups(claim string) []string {
+	var groups []string
+	switch v := c.raw[claim].(type) {
+	case []any:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	case string:
+		groups = append(groups, v)
+	}
+	return groups
+}
+
+// verifyIDToken checks an ID token's signature against the provider's keys
+// and its issuer, audience, lifetime and nonce.
+func (p *oidcProvider) verifyIDToken(ctx context.Context, token, clientID, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+	headerJSON, err1 := decodeBase64URL(parts[0])
+	payload, err2 := decodeBase64URL(parts[1])
+	sig, err3 := decodeBase64URL(parts[2])
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, errors.New("malformed ID token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, errors.New("malformed ID token header")
+	}
+
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	valid := false
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		valid = header.Alg == "RS256" && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig) == nil
+	case *ecdsa.PublicKey:
+		valid = header.Alg == "ES256" && len(sig) == 64 &&
+			ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	}
+	if !valid {
+		return nil, fmt.Errorf("invalid ID token signature (alg %q)", header.Alg)
+	}
+
+	var claims idTokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("decoding ID token claims: %w", err)
+	}
+	json.Unmarshal(payload, &claims.raw)
+
+	now := time.Now()
+	switch {
+	case claims.Issuer != p.Issuer:
+		return nil, fmt.Errorf("ID token issuer %q does not match %q", claims.Issuer, p.Issuer)
+	case !slices.Contains(claims.Audience, clientID):
+		return nil, errors.New("ID token was not issued to this client")
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != clientID:
+		return nil, errors.New("ID token authorized party does not match this client")
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcClockSkew)):
+		return nil, errors.New("ID token has expired")
+	case time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)):
+		return nil, errors.New("ID token was issued in the future")
+	case claims.Nonce != nonce:
+		return nil, errors.New("ID token nonce does not match")
+	case claims.Subject == "":
+		return nil, errors.New("ID token has no subject")
+	}
+	return &claims, nil
+}
+
+// exchangeCode trades an authorization code for the ID token.
+func (p *oidcProvider) exchangeCode(ctx context.Context, cfg *OIDCConfig, code, redirectURL, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {redirectURL},
+		"code_verifier": {verifier},
+	}
+	if cfg.ClientSecret == "" {
+		form.Set("client_id", cfg.ClientID) // public client
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("calling token endpoint: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %d: %s", resp.StatusCode, body)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.Unmarshal(body, &tokens); err != nil || tokens.IDToken == "" {
+		return "", errors.New("token endpoint returned no ID token")
+	}
+	return tokens.IDToken, nil
+}
+
+// --- Database methods ---
+
+// CreateOIDCState remembers an authorization request until the provider
+// redirects back.
+func (db *DB) CreateOIDCState(state, nonce, verifier, redirectURL string) error {
+	now := time.Now()
+	db.conn.Exec(`DELETE FROM oidc_states WHERE expires_at <= ?`, now)
+	_, err := db.conn.Exec(`
+		INSERT INTO oidc_states (state, nonce, code_verifier, redirect_url, expires_at) VALUES (?, ?, ?, ?, ?)
+	`, state, nonce, verifier, redirectURL, now.Add(oidcStateTTL))
+	return err
+}
+
+// ConsumeOIDCState deletes a pending authorization request and returns its
+// nonce, PKCE verifier and redirect URL. ok is false if it is unknown or expired.
+func (db *DB) ConsumeOIDCState(state string) (nonce, verifier, redirectURL string, ok bool, err error) {
+	var expiresAt time.Time
+	err = db.conn.QueryRow(`
+		SELECT nonce, code_verifier, redirect_url, expires_at FROM oidc_states WHERE state = ?
+	`, state).Scan(&nonce, &verifier, &redirectURL, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", "", "", false, nil
+	}
+	if err != nil {
+		return "", "", "", false, err
+	}
+	result, err := db.conn.Exec(`DELETE FROM oidc_states WHERE state = ?`, state)
+	if err != nil {
+		return "", "", "", false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 || time.Now().After(expiresAt) {
+		return "", "", "", false, nil
+	}
+	return nonce, verifier, redirectURL, true, nil
+}
+
+// userIDWhere returns the ID of the first user matching a condition, or 0.
+func (db *DB) userIDWhere(cond string, args ...any) (int, error) {
+	var id int
+	err := db.conn.QueryRow(`SELECT id FROM users WHERE `+cond+` ORDER BY id LIMIT 1`, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
+
+// ResolveOIDCUser finds the user for a verified ID token, or creates one.
+// Users are matched by subject first; a verified email links an existing
+// account with that email address, as set by an earlier SSO login or by an
+// admin. Usernames are never matched: anyone may pick a username that looks
+// like someone else's address.
+func (db *DB) ResolveOIDCUser(claims *idTokenClaims) (*User, error) {
+	id, err := db.userIDWhere(`oidc_subject = ?`, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if id == 0 && claims.Email != "" && claims.emailVerified() {
+		id, err = db.userIDWhere(`oidc_subject IS NULL AND lower(email) = lower(?)`, claims.Email)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if id != 0 {
+		_, err := db.conn.Exec(`
+			UPDATE users SET oidc_subject = ?, email = COALESCE(NULLIF(?, ''), email) WHERE id = ?
+		`, claims.Subject, claims.Email, id)
+		if err != nil {
+			return nil, err
+		}
+		return db.GetUserByID(id)
+	}
+
+	username, err := db.freeUsername(claims.PreferredUsername, claims.Email, "user-"+claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	// SSO users sign in through the provider; the password is random and unknown
+	password, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+	encKey := make([]byte, 32)
+	if _, err := rand.Read(encKey); err != nil {
+		return nil, fmt.Errorf("generating encryption key: %w", err)
+	}
+	user, err := db.CreateUser(username, password, false, encKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	displayName := claims.Name
+	if displayName == "" {
+		displayName = username
+	}
+	if _, err := db.conn.Exec(`
+		UPDATE users SET oidc_subject = ?, email = NULLIF(?, ''), display_name = ? WHERE id = ?
+	`, claims.Subject, claims.Email, displayName, user.ID); err != nil {
+		return nil, err
+	}
+	log.Printf("SSO: created user %q", username)
+	return db.GetUserByID(user.ID)
+}
+
+// freeUsername returns the first usable candidate, adding a numeric suffix
+// if it is taken.
+func (db *DB) freeUsername(candidates ...string) (string, error) {
+	base := ""
+	for _, c := range candidates {
+		if c = strings.TrimSpace(c); c != "" {
+			base = c
+			break
+		}
+	}
+	for i := 1; i < 100; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		id, err := db.userIDWhere(`username = ?`, name)
+		if err != nil {
+			return "", err
+		}
+		if id == 0 {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no free username for %q", base)
+}
+
+// SetUserAdmin grants or revokes admin rights. The last admin cannot be demoted.
+func (db *DB) SetUserAdmin(id int, isAdmin bool) error {
+	if !isAdmin {
+		var others int
+		if err := db.conn.QueryRow(`SELECT COUNT(*) FROM users WHERE is_admin AND id != ?`, id).Scan(&others); err != nil {
+			return err
+		}
+		if others == 0 {
+			return errors.New("cannot remove the last admin")
+		}
+	}
+	_, err := db.conn.Exec(`UPDATE users SET is_admin = ? WHERE id = ?`, isAdmin, id)
+	return err
+}
+
+// errEmailTaken is returned when an email address already belongs to
+// another account; SSO links by email, so it must be unique.
+var errEmailTaken = errors.New("email is already used by another account")
+
+// SetUserEmail sets the verified email an SSO login links the account by.
+// An empty email clears it. Returns sql.ErrNoRows if the user doesn't exist.
+func (db *DB) SetUserEmail(id int, email string) error {
+	if email != "" {
+		other, err := db.userIDWhere(`id != ? AND lower(email) = lower(?)`, id, email)
+		if err != nil {
+			return err
+		}
+		if other != 0 {
+			return errEmailTaken
+		}
+	}
+	result, err := db.conn.Exec(`UPDATE users SET email = NULLIF(?, '') WHERE id = ?`, email, id)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// --- HTTP handlers ---
+
+// oidcStateCookie binds an authorization request to the browser that started it.
+const oidcStateCookie = "oidc_state"
+
+// oidcFail ends a failed SSO login by sending the browser back to the app
+// with the reason in the URL fragment.
+func oidcFail(w http.ResponseWriter, r *http.Request, msg string) {
+	log.Printf("SSO: %s", msg)
+	http.Redirect(w, r, "/#sso_error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+// handleOIDCStatus handles GET /api/auth/oidc, telling the login page
+// whether to offer single sign-on.
+func handleOIDCStatus(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, _ := getOIDCConfig(db)
+		writeJSON(w, http.StatusOK, map[string]bool{"enabled": cfg != nil})
+	}
+}
+
+// handleOIDCLogin handles GET /api/auth/oidc/login by redirecting to the
+// provider with a PKCE (S256) authorization request.
+func handleOIDCLogin(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := getOIDCConfig(db)
+		if err != nil || cfg == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "single sign-on is not configured"})
+			return
+		}
+		provider, err := oidcProviders.get(r.Context(), cfg.Issuer)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("identity provider unavailable: %v", err)})
+			return
+		}
+
+		state, err1 := randomHex(16)
+		nonce, err2 := randomHex(16)
+		verifier, err3 := randomURLSafe(32)
+		if err := errors.Join(err1, err2, err3); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start login"})
+			return
+		}
+		verifier = strings.TrimRight(verifier, "=")
+		redirectURL := cfg.redirectURL(r)
+		if err := db.CreateOIDCState(state, nonce, verifier, redirectURL); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start login"})
+			return
+		}
+
+		challenge := sha256.Sum256([]byte(verifier))
+		q := url.Values{
+			"response_type":         {"code"},
+			"client_id":             {cfg.ClientID},
+			"redirect_uri":          {redirectURL},
+			"scope":                 {cfg.scopes()},
+			"state":                 {state},
+			"nonce":                 {nonce},
+			"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+			"code_challenge_method": {"S256"},
+		}
+		sep := "?"
+		if strings.Contains(provider.AuthorizationEndpoint, "?") {
+			sep = "&"
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     oidcStateCookie,
+			Value:    state,
+			Path:     "/api/auth/oidc",
+			MaxAge:   int(oidcStateTTL.Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil || r.Header.Get("Cf-Connecting-Ip") != "",
+			SameSite: http.SameSiteLaxMode,
+		})
+		http.Redirect(w, r, provider.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+	}
+}
+
+// handleOIDCCallback handles GET /api/auth/oidc/callback. On success the
+// browser is sent to the app with a session cookie and, as with invite
+// links, the user's encryption key in the URL fragment (#key=...), which
+// never reaches a server. Users with two-factor authentication get a login
+// challenge instead (#two_factor_challenge=...), to finish at /api/auth/login/2fa
+// like a password login.
+func handleOIDCCallback(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		state := q.Get("state")
+		cookie, err := r.Cookie(oidcStateCookie)
+		http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Value: "", Path: "/api/auth/oidc", MaxAge: -1, HttpOnly: true})
+		if err != nil || state == "" || cookie.Value != state {
+			oidcFail(w, r, "login session mismatch; start again")
+			return
+		}
+		nonce, verifier, redirectURL, ok, err := db.ConsumeOIDCState(state)
+		if err != nil || !ok {
+			oidcFail(w, r, "login request expired; start again")
+			return
+		}
+		if e := q.Get("error"); e != "" {
+			oidcFail(w, r, "identity provider refused the login: "+e)
+			return
+		}
+
+		cfg, err := getOIDCConfig(db)
+		if err != nil || cfg == nil {
+			oidcFail(w, r, "single sign-on is not configured")
+			return
+		}
+		provider, err := oidcProviders.get(r.Context(), cfg.Issuer)
+		if err != nil {
+			oidcFail(w, r, fmt.Sprintf("identity provider unavailable: %v", err))
+			return
+		}
+		idToken, err := provider.exchangeCode(r.Context(), cfg, q.Get("code"), redirectURL, verifier)
+		if err != nil {
+			oidcFail(w, r, err.Error())
+			return
+		}
+		claims, err := provider.verifyIDToken(r.Context(), idToken, cfg.ClientID, nonce)
+		if err != nil {
+			oidcFail(w, r, err.Error())
+			return
+		}
+
+		user, err := db.ResolveOIDCUser(claims)
+		if err != nil || user == nil {
+			oidcFail(w, r, "could not create or link the account")
+			return
+		}
+		if cfg.AdminGroup != "" {
+			isAdmin := slices.Contains(claims.groups(cfg.groupsClaim()), cfg.AdminGroup)
+			if isAdmin != user.IsAdmin {
+				if err := db.SetUserAdmin(user.ID, isAdmin); err != nil {
+					log.Printf("SSO: updating admin rights of %q: %v", user.Username, err)
+				} else {
+					user.IsAdmin = isAdmin
+				}
+			}
+		}
+
+		if user.TwoFactorEnabled {
+			challenge, err := db.CreateLoginChallenge(user.ID)
+			if err != nil {
+				oidcFail(w, r, "failed to start two-factor login")
+				return
+			}
+			http.Redirect(w, r, "/#two_factor_challenge="+url.QueryEscape(challenge), http.StatusFound)
+			return
+		}
+
+		sessionID, err := db.CreateSession(user.ID, getIP(r), r.UserAgent())
+		if err != nil {
+			oidcFail(w, r, "failed to create session")
+			return
+		}
+		setSessionCookie(w, r, sessionID)
+		http.Redirect(w, r, "/#key="+url.QueryEscape(base64.StdEncoding.EncodeToString(user.EncryptionKey)), http.StatusFound)
+	}
+}
+
+// handleGetOIDCConfig handles GET /api/admin/oidc. The client secret is
+// never returned.
+func handleGetOIDCConfig(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cfg, err := getOIDCConfig(db)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load SSO settings"})
+			return
+		}
+		if cfg == nil {
+			writeJSON(w, http.StatusOK, map[string]any{"enabled": false})
+			return
+		}
+		hasSecret := cfg.ClientSecret != ""
+		cfg.ClientSecret = ""
+		writeJSON(w, http.StatusOK, map[string]any{
+			"enabled":           true,
+			"config":            cfg,
+			"client_secret_set": hasSecret,
+			"redirect_url":      cfg.redirectURL(r),
+		})
+	}
+}
+
+// handleSetOIDCConfig handles PUT /api/admin/oidc. An empty issuer turns
+// SSO off; an omitted client secret keeps the stored one. The provider's
+// discovery document is fetched to check the issuer before saving.
+func handleSetOIDCConfig(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var cfg OIDCConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if cfg.Issuer == "" {
+			db.SetConfig("oidc", "")
+			writeJSON(w, http.StatusOK, map[string]string{"status": "disabled"})
+			return
+		}
+		if cfg.ClientID == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "client_id is required"})
+			return
+		}
+		if cfg.ClientSecret == "" {
+			if old, _ := getOIDCConfig(db); old != nil && old.Issuer == cfg.Issuer {
+				cfg.ClientSecret = old.ClientSecret
+			}
+		}
+		if _, err := oidcProviders.get(r.Context(), cfg.Issuer); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("could not reach the identity provider: %v", err)})
+			return
+		}
+
+		raw, _ := json.Marshal(cfg)
+		if err := db.SetConfig("oidc", string(raw)); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save SSO settings"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "updated", "redirect_url": cfg.redirectURL(r)})
+	}
+}
+
+// handleSetUserEmail handles PUT /api/admin/users/{id}/email. The admin
+// vouches for the address: the next SSO login with that verified email
+// signs in to this account instead of creating a new one.
+func handleSetUserEmail(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+			return
+		}
+
+		var req struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		req.Email = strings.TrimSpace(req.Email)
+		if req.Email != "" {
+			if addr, err := mail.ParseAddress(req.Email); err != nil || addr.Address != req.Email {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid email address"})
+				return
+			}
+		}
+
+		switch err := db.SetUserEmail(id, req.Email); err {
+		case nil:
+			writeJSON(w, http.StatusOK, map[string]any{"user_id": id, "email": req.Email})
+		case sql.ErrNoRows:
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+		case errEmailTaken:
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		default:
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update email"})
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -87,11 +88,17 @@ func (c *OllamaClient) ListRunningModels() ([]RunningModel, error) {
 }
 
 // PullModelStream pulls a model from Ollama with streaming progress.
-// Each line from Ollama is forwarded to onLine as raw JSON bytes.
-func (c *OllamaClient) PullModelStream(name string, onLine func([]byte) error) error {
+// Each line from Ollama is forwarded to onLine as raw JSON bytes. Cancelling
+// ctx aborts the download.
+func (c *OllamaClient) PullModelStream(ctx context.Context, name string, onLine func([]byte) error) error {
 	body, _ := json.Marshal(map[string]any{"name": name, "stream": true})
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+"/api/pull", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
 	client := &http.Client{Timeout: 0}
-	resp, err := client.Post(c.BaseURL+"/api/pull", "application/json", bytes.NewReader(body))
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("calling Ollama: %w", err)
 	}
@@ -139,45 +146,231 @@ func (c *OllamaClient) DeleteModel(name string) error {
 	return nil
 }
 
-// ChatMessage is a single message in a conversation (user, assistant, or system).
+// LoadModel loads a model without generating anything, via an empty
+// /api/generate call, and sets how long Ollama keeps it loaded. A keepAlive
+// of "0" unloads the model immediately.
+func (c *OllamaClient) LoadModel(ctx context.Context, name, keepAlive string) error {
+	body, _ := json.Marshal(map[string]any{"model": name, "keep_alive": keepAliveValue(keepAlive), "stream": false})
+	resp, err := c.postInference(ctx, "/api/generate", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("Ollama returned %d: %s", resp.StatusCode, b)
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// EmbedResponse holds one embedding vector per input, in input order.
+type EmbedResponse struct {
+	Model        string      `json:"model"`
+	Embeddings   [][]float32 `json:"embeddings"`
+	PromptTokens int         `json:"prompt_eval_count"`
+}
+
+// Embed computes embeddings for each input via Ollama's /api/embed.
+// dimensions truncates the vectors when the model supports it (0 = model default).
+func (c *OllamaClient) Embed(ctx context.Context, model string, input []string, dimensions int) (*EmbedResponse, error) {
+	reqBody := map[string]any{"model": model, "input": input}
+	if dimensions > 0 {
+		reqBody["dimensions"] = dimensions
+	}
+	bodyBytes, err := json.Marshal(reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling request: %w", err)
+	}
+
+	// Large batches can take a while, same as chat
+	resp, err := c.postInference(ctx, "/api/embed", bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("Ollama returned %d: %s", resp.StatusCode, body)
+	}
+
+	var result EmbedResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding Ollama response: %w", err)
+	}
+	if len(result.Embeddings) != len(input) {
+		return nil, fmt.Errorf("Ollama returned %d embeddings for %d inputs", len(result.Embeddings), len(input))
+	}
+	return &result, nil
+}
+
+// GenerateRequest is a raw text completion call to Ollama's /api/generate.
+type GenerateRequest struct {
+	Model   string         `json:"model"`
+	Prompt  string         `json:"prompt"`
+	Suffix  string         `json:"suffix,omitempty"` // fill-in-the-middle: text after the cursor
+	Stream  bool           `json:"stream"`
+	Options map[string]any `json:"options,omitempty"`
+}
+
+// GenerateResponse is a full /api/generate response, or one line of its stream.
+type GenerateResponse struct {
+	Response        string `json:"response"`
+	Done            bool   `json:"done"`
+	DoneReason      string `json:"done_reason,omitempty"` // "stop" or "length"
+	PromptEvalCount int    `json:"prompt_eval_count,omitempty"`
+	EvalCount       int    `json:"eval_count,omitempty"`
+}
+
+// Generate runs a non-streaming text completion.
+func (c *OllamaClient) Generate(ctx context.Context, req GenerateRequest) (*GenerateResponse, error) {
+	req.Stream = false
+	resp, err := c.postGenerate(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result GenerateResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding Ollama response: %w", err)
+	}
+	return &result, nil
+}
+
+// GenerateStream runs a streaming text completion, calling onChunk for each
+// line Ollama sends. The final chunk has Done=true and carries token counts.
+func (c *OllamaClient) GenerateStream(ctx context.Context, req GenerateRequest, onChunk func(GenerateResponse) error) error {
+	req.Stream = true
+	resp, err := c.postGenerate(ctx, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var chunk GenerateResponse
+		if err := json.Unmarshal(line, &chunk); err != nil {
+			continue
+		}
+		if err := onChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *OllamaClient) postGenerate(ctx context.Context, req GenerateRequest) (*http.Response, error) {
+	bodyBytes, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling request: %w", err)
+	}
+
+	resp, err := c.postInference(ctx, "/api/generate", bodyBytes)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("Ollama returned %d: %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// ChatMessage is a single message in a conversation (user, assistant, system, or tool).
+// Content may also be decoded from OpenAI content-part arrays; see UnmarshalJSON.
 type ChatMessage struct {
-	Role      string `json:"role"`
-	Content   string `json:"content"`
-	Encrypted bool   `json:"encrypted,omitempty"`
-	IV        string `json:"iv,omitempty"`
+	Role       string     `json:"role"`
+	Content    string     `json:"content"`
+	Images     []string   `json:"images,omitempty"` // base64-encoded image bytes, as Ollama expects
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string     `json:"tool_call_id,omitempty"` // OpenAI: the call a "tool" message answers
+	ToolName   string     `json:"tool_name,omitempty"`    // Ollama: the function a "tool" message answers
+	Encrypted  bool       `json:"encrypted,omitempty"`
+	IV         string     `json:"iv,omitempty"`
+}
+
+// Tool is a function the model may call. OpenAI and Ollama share this shape.
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
 }
 
-// ChatRequest is what our server accepts from clients.
+// ToolCall is a function call requested by the model. Ollama sends Arguments
+// as a JSON object; OpenAI clients send it as a JSON-encoded string.
+type ToolCall struct {
+	ID       string           `json:"id,omitempty"`
+	Type     string           `json:"type,omitempty"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+// ChatRequest describes one chat call to the model.
 type ChatRequest struct {
-	Model    string        `json:"model"`
-	Messages []ChatMessage `json:"messages"`
+	Model    string          `json:"model"`
+	Messages []ChatMessage   `json:"messages"`
+	Options  map[string]any  `json:"options,omitempty"`
+	Tools    []Tool          `json:"tools,omitempty"`
+	Format   json.RawMessage `json:"format,omitempty"` // "json" or a JSON schema
+	// KeepAlive is how long Ollama keeps the model loaded afterwards ("" = Ollama's default).
+	KeepAlive string `json:"keep_alive,omitempty"`
 }
 
 // ChatResponse is the non-streaming response we return.
 type ChatResponse struct {
-	Model   string      `json:"model"`
-	Message ChatMessage `json:"message"`
+	Model            string      `json:"model"`
+	Message          ChatMessage `json:"message"`
+	DoneReason       string      `json:"done_reason,omitempty"`
+	PromptTokens     int         `json:"prompt_tokens,omitempty"`
+	CompletionTokens int         `json:"completion_tokens,omitempty"`
 }
 
 type ollamaChatRequest struct {
-	Model    string         `json:"model"`
-	Messages []ChatMessage  `json:"messages"`
-	Stream   bool           `json:"stream"`
-	Options  map[string]any `json:"options,omitempty"`
+	Model     string          `json:"model"`
+	Messages  []ChatMessage   `json:"messages"`
+	Stream    bool            `json:"stream"`
+	Options   map[string]any  `json:"options,omitempty"`
+	Tools     []Tool          `json:"tools,omitempty"`
+	Format    json.RawMessage `json:"format,omitempty"`
+	KeepAlive any             `json:"keep_alive,omitempty"`
 }
 
 type ollamaChatResponse struct {
-	Message ChatMessage `json:"message"`
-	Done    bool        `json:"done"`
+	Message         ChatMessage `json:"message"`
+	Done            bool        `json:"done"`
+	DoneReason      string      `json:"done_reason,omitempty"`       // "stop" or "length"
+	PromptEvalCount int         `json:"prompt_eval_count,omitempty"` // only on the final message
+	EvalCount       int         `json:"eval_count,omitempty"`        // only on the final message
 }
 
 // Chat sends a non-streaming chat request to Ollama and returns the full response.
-func (c *OllamaClient) Chat(model string, messages []ChatMessage, options map[string]any) (*ChatResponse, error) {
+func (c *OllamaClient) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
 	reqBody := ollamaChatRequest{
-		Model:    model,
-		Messages: messages,
-		Stream:   false,
-		Options:  options,
+		Model:     req.Model,
+		Messages:  req.Messages,
+		Stream:    false,
+		Options:   req.Options,
+		Tools:     req.Tools,
+		Format:    req.Format,
+		KeepAlive: keepAliveValue(req.KeepAlive),
 	}
 
 	bodyBytes, err := json.Marshal(reqBody)
@@ -185,11 +378,9 @@ func (c *OllamaClient) Chat(model string, messages []ChatMessage, options map[st
 		return nil, fmt.Errorf("marshaling request: %w", err)
 	}
 
-	// No timeout for inference -- it can take a while on slower hardware
-	client := &http.Client{Timeout: 0}
-	resp, err := client.Post(c.BaseURL+"/api/chat", "application/json", bytes.NewReader(bodyBytes))
+	resp, err := c.postInference(ctx, "/api/chat", bodyBytes)
 	if err != nil {
-		return nil, fmt.Errorf("calling Ollama: %w", err)
+		return nil, err
 	}
 	defer resp.Body.Close()
 
@@ -204,27 +395,38 @@ func (c *OllamaClient) Chat(model string, messages []ChatMessage, options map[st
 	}
 
 	return &ChatResponse{
-		Model:   model,
-		Message: ollamaResp.Message,
+		Model:            req.Model,
+		Message:          ollamaResp.Message,
+		DoneReason:       ollamaResp.DoneReason,
+		PromptTokens:     ollamaResp.PromptEvalCount,
+		CompletionTokens: ollamaResp.EvalCount,
 	}, nil
 }
 
 // StreamChunk is one piece of a streaming response.
+// Token counts are only set on the final chunk.
 type StreamChunk struct {
-	Content   string `json:"content"`
-	Encrypted bool   `json:"encrypted,omitempty"`
-	IV        string `json:"iv,omitempty"`
-	Done      bool   `json:"done"`
+	Content          string     `json:"content"`
+	ToolCalls        []ToolCall `json:"tool_calls,omitempty"`
+	Encrypted        bool       `json:"encrypted,omitempty"`
+	IV               string     `json:"iv,omitempty"`
+	Done             bool       `json:"done"`
+	DoneReason       string     `json:"done_reason,omitempty"`
+	PromptTokens     int        `json:"prompt_tokens,omitempty"`
+	CompletionTokens int        `json:"completion_tokens,omitempty"`
 }
 
 // ChatStream sends a streaming chat request. It calls onChunk for each token
-// as it arrives from Ollama. The final chunk has Done=true.
-func (c *OllamaClient) ChatStream(model string, messages []ChatMessage, options map[string]any, onChunk func(StreamChunk) error) error {
+// as it arrives from Ollama. The final chunk has Done=true and carries token counts.
+func (c *OllamaClient) ChatStream(ctx context.Context, req ChatRequest, onChunk func(StreamChunk) error) error {
 	reqBody := ollamaChatRequest{
-		Model:    model,
-		Messages: messages,
-		Stream:   true,
-		Options:  options,
+		Model:     req.Model,
+		Messages:  req.Messages,
+		Stream:    true,
+		Options:   req.Options,
+		Tools:     req.Tools,
+		Format:    req.Format,
+		KeepAlive: keepAliveValue(req.KeepAlive),
 	}
 
 	bodyBytes, err := json.Marshal(reqBody)
@@ -232,10 +434,9 @@ func (c *OllamaClient) ChatStream(model string, messages []ChatMessage, options
 		return fmt.Errorf("marshaling request: %w", err)
 	}
 
-	client := &http.Client{Timeout: 0}
-	resp, err := client.Post(c.BaseURL+"/api/chat", "application/json", bytes.NewReader(bodyBytes))
+	resp, err := c.postInference(ctx, "/api/chat", bodyBytes)
 	if err != nil {
-		return fmt.Errorf("calling Ollama: %w", err)
+		return err
 	}
 	defer resp.Body.Close()
 
@@ -257,8 +458,12 @@ func (c *OllamaClient) ChatStream(model string, messages []ChatMessage, options
 		}
 
 		chunk := StreamChunk{
-			Content: ollamaResp.Message.Content,
-			Done:    ollamaResp.Done,
+			Content:          ollamaResp.Message.Content,
+			ToolCalls:        ollamaResp.Message.ToolCalls,
+			Done:             ollamaResp.Done,
+			DoneReason:       ollamaResp.DoneReason,
+			PromptTokens:     ollamaResp.PromptEvalCount,
+			CompletionTokens: ollamaResp.EvalCount,
 		}
 		if err := onChunk(chunk); err != nil {
 			return err
@@ -267,3 +472,21 @@ func (c *OllamaClient) ChatStream(model string, messages []ChatMessage, options
 
 	return scanner.Err()
 }
+
+// postInference POSTs a JSON body to an inference endpoint. There is no
+// timeout -- generation can take a while on slower hardware -- but cancelling
+// ctx (e.g. the client disconnecting) aborts the call and frees the GPU.
+func (c *OllamaClient) postInference(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.BaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 0}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("calling Ollama: %w", err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Ollama-native API proxy under /ollama/, for clients that only speak Ollama's
+// own protocol (Open WebUI in Ollama mode, the ollama CLI via OLLAMA_HOST).
+// Requests are authenticated with Fireside API keys and, like everything
+// else, blocked by pauseMiddleware while the server is paused.
+
+const ollamaProxyPrefix = "/ollama"
+
+// ollamaProxyPaths lists the Ollama endpoints any API key may use.
+// The value reports whether the call runs inference (and so counts toward quotas and usage).
+var ollamaProxyPaths = map[string]bool{
+	"/api/chat":       true,
+	"/api/generate":   true,
+	"/api/embed":      true,
+	"/api/embeddings": true,
+	"/api/tags":       false,
+	"/api/show":       false,
+	"/api/ps":         false,
+	"/api/version":    false,
+}
+
+// ollamaAdminPaths are model-management endpoints reserved for keys owned by an admin.
+var ollamaAdminPaths = []string{
+	"/api/pull",
+	"/api/push",
+	"/api/delete",
+	"/api/create",
+	"/api/copy",
+	"/api/blobs/",
+}
+
+// ollamaRouter picks the Ollama server that should handle a request for a
+// model. OllamaClient routes everything to itself; UpstreamPool routes by model.
+type ollamaRouter interface {
+	ListModels() ([]Model, error)
+	ollamaFor(model string) (client *OllamaClient, done func(), err error)
+}
+
+func (c *OllamaClient) ollamaFor(model string) (*OllamaClient, func(), error) {
+	return c, func() {}, nil
+}
+
+type proxyTargetKey struct{}
+
+// handleOllamaProxy forwards /ollama/api/... to an upstream Ollama, streaming responses verbatim.
+func handleOllamaProxy(db *DB, router ollamaRouter) http.HandlerFunc {
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			target := pr.In.Context().Value(proxyTargetKey{}).(*url.URL)
+			pr.SetURL(target)
+			pr.Out.URL.Path = strings.TrimSuffix(target.Path, "/") + strings.TrimPrefix(pr.In.URL.Path, ollamaProxyPrefix)
+			pr.Out.URL.RawPath = ""
+			pr.Out.Host = target.Host
+			// Fireside credentials are for Fireside only
+			pr.Out.Header.Del("Authorization")
+			pr.Out.Header.Del("x-api-key")
+			pr.Out.Header.Del("Cookie")
+		},
+		FlushInterval: -1, // stream NDJSON lines as soon as Ollama writes them
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Ollama proxy error: %v", err)
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "failed to reach Ollama"})
+		},
+	}
+
+	// forward sends r to the upstream that hosts model.
+	forward := func(w http.ResponseWriter, r *http.Request, model string) {
+		client, done, err := router.ollamaFor(model)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+			return
+		}
+		defer done()
+		target, err := url.Parse(client.BaseURL)
+		if err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": "invalid Ollama URL"})
+			return
+		}
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyTargetKey{}, target)))
+	}
+
+	// Inference calls count toward quotas, go through the inference queue, and
+	// are recorded in the usage ledger. Watch the response for Ollama's final token counts.
+	proxyInference := requireQuota(db, func(w http.ResponseWriter, r *http.Request) {
+		model := peekModel(r)
+		if !modelPermitted(r.Context(), model) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("you don't have access to model %q", model)})
+			return
+		}
+
+		ticket, err := inferenceQueue.EnqueueRequest(r)
+		if err == nil {
+			defer ticket.Release()
+			err = ticket.Wait(nil)
+		}
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "server is busy: " + err.Error()})
+			return
+		}
+
+		start := time.Now()
+		tap := &ollamaUsageTap{ResponseWriter: w, status: http.StatusOK}
+		forward(tap, r, model)
+
+		var callErr error
+		if tap.status >= 400 {
+			callErr = errOllamaProxyStatus
+		}
+		promptTokens, completionTokens := tap.counts()
+		recordUsage(db, r, model, start, promptTokens, completionTokens, callErr)
+	})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, ollamaProxyPrefix)
+		if path == "" || path == "/" {
+			// Ollama clients probe the root to check the server is up
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			io.WriteString(w, "Ollama is running")
+			return
+		}
+
+		inference, allowed := ollamaProxyPaths[path]
+		if !allowed {
+			for _, p := range ollamaAdminPaths {
+				if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+					if user := UserFromContext(r.Context()); user == nil || !user.IsAdmin {
+						writeJSON(w, http.StatusForbidden, map[string]string{"error": "this operation requires an admin API key"})
+						return
+					}
+					allowed = true
+					break
+				}
+			}
+		}
+		if !allowed {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "endpoint not available through the Fireside proxy"})
+			return
+		}
+
+		if path != "/api/tags" && !strings.HasPrefix(path, "/api/blobs/") {
+			// The proxy passes requests through verbatim, so presets and aliases can't be expanded
+			if model := peekModel(r); model != "" {
+				msg, err := chatOnlyModel(db, model)
+				if err != nil {
+					writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to resolve model"})
+					return
+				}
+				if msg != "" {
+					writeJSON(w, http.StatusBadRequest, map[string]string{"error": msg})
+					return
+				}
+			}
+		}
+
+		switch {
+		case path == "/api/tags":
+			// Answered here so that every upstream's models are listed
+			models, err := router.ListModels()
+			if err != nil {
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"models": permittedModels(r.Context(), models)})
+		case inference:
+			proxyInference(w, r)
+		case strings.HasPrefix(path, "/api/blobs/"):
+			forward(w, r, "") // binary upload; nothing to peek at
+		default:
+			forward(w, r, peekModel(r))
+		}
+	}
+}
+
+// peekModel reads the model name from a JSON request body and restores the body.
+// Older Ollama clients send it as "name".
+func peekModel(r *http.Request) string {
+	if r.Body == nil || r.Body == http.NoBody {
+		return ""
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return ""
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var peek struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+	json.Unmarshal(body, &peek)
+	if peek.Model == "" {
+		return peek.Name
+	}
+	return peek.Model
+}
+
+var errOllamaProxyStatus = errors.New("Ollama returned an error status")
+
+// ollamaUsageTap passes a proxied response through untouched while keeping
+// the last complete NDJSON line, which is where Ollama reports token counts.
+type ollamaUsageTap struct {
+	http.ResponseWriter
+	status  int
+	partial []byte
+	last    []byte
+}
+
+func (t *ollamaUsageTap) WriteHeader(status int) {
+	t.status = status
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *ollamaUsageTap) Write(p []byte) (int, error) {
+	t.partial = append(t.partial, p...)
+	if i := bytes.LastIndexByte(t.partial, '\n'); i >= 0 {
+		lines := bytes.TrimRight(t.partial[:i], "\n")
+		if j := bytes.LastIndexByte(lines, '\n'); j >= 0 {
+			lines = lines[j+1:]
+		}
+		if len(lines) > 0 {
+			t.last = append(t.last[:0], lines...)
+		}
+		t.partial = append(t.partial[:0], t.partial[i+1:]...)
+	}
+	return t.ResponseWriter.Write(p)
+}
+
+func (t *ollamaUsageTap) Flush() {
+	if f, ok := t.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// counts returns prompt and completion tokens from the final response line.
+func (t *ollamaUsageTap) counts() (int, int) {
+	final := t.last
+	if len(bytes.TrimSpace(t.partial)) > 0 {
+		final = t.partial // non-streaming responses may not end in a newline
+	}
+	var c struct {
+		PromptEvalCount int `json:"prompt_eval_count"`
+		EvalCount       int `json:"eval_count"`
+	}
+	json.Unmarshal(final, &c)
+	return c.PromptEvalCount, c.EvalCount
+}
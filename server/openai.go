@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -12,17 +15,71 @@ import (
 // These match the format that the Python openai client, LangChain, Cursor, etc. expect.
 
 type openAIRequest struct {
-	Model            string        `json:"model"`
-	Messages         []ChatMessage `json:"messages"`
-	Stream           bool          `json:"stream"`
-	Temperature      *float64      `json:"temperature,omitempty"`
-	MaxTokens        *int          `json:"max_tokens,omitempty"`
-	MaxCompTokens    *int          `json:"max_completion_tokens,omitempty"`
-	TopP             *float64      `json:"top_p,omitempty"`
-	Stop             any           `json:"stop,omitempty"`
-	FrequencyPenalty *float64      `json:"frequency_penalty,omitempty"`
-	PresencePenalty  *float64      `json:"presence_penalty,omitempty"`
-	N                *int          `json:"n,omitempty"`
+	Model            string                `json:"model"`
+	Messages         []ChatMessage         `json:"messages"`
+	Stream           bool                  `json:"stream"`
+	Temperature      *float64              `json:"temperature,omitempty"`
+	MaxTokens        *int                  `json:"max_tokens,omitempty"`
+	MaxCompTokens    *int                  `json:"max_completion_tokens,omitempty"`
+	TopP             *float64              `json:"top_p,omitempty"`
+	Stop             any                   `json:"stop,omitempty"`
+	FrequencyPenalty *float64              `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64              `json:"presence_penalty,omitempty"`
+	N                *int                  `json:"n,omitempty"`
+	StreamOptions    *openAIStreamOptions  `json:"stream_options,omitempty"`
+	Tools            []Tool                `json:"tools,omitempty"`
+	ToolChoice       any                   `json:"tool_choice,omitempty"` // "none", "auto", "required", or {"type":"function","function":{"name":...}}
+	ResponseFormat   *openAIResponseFormat `json:"response_format,omitempty"`
+}
+
+// openAIResponseFormat is {"type":"text"}, {"type":"json_object"}, or
+// {"type":"json_schema","json_schema":{"name":...,"schema":{...},"strict":true}}.
+type openAIResponseFormat struct {
+	Type       string `json:"type"`
+	JSONSchema *struct {
+		Name   string          `json:"name"`
+		Schema json.RawMessage `json:"schema"`
+		Strict bool            `json:"strict"`
+	} `json:"json_schema,omitempty"`
+}
+
+// ollamaFormat returns the value for Ollama's "format" parameter, or nil for plain text.
+func (f *openAIResponseFormat) ollamaFormat() (json.RawMessage, error) {
+	if f == nil {
+		return nil, nil
+	}
+	switch f.Type {
+	case "", "text":
+		return nil, nil
+	case "json_object":
+		return json.RawMessage(`"json"`), nil
+	case "json_schema":
+		if f.JSONSchema == nil || len(f.JSONSchema.Schema) == 0 {
+			return nil, fmt.Errorf("response_format.json_schema.schema is required for type 'json_schema'")
+		}
+		var probe map[string]any
+		if err := json.Unmarshal(f.JSONSchema.Schema, &probe); err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema must be a JSON object")
+		}
+		if err := checkSchema(probe); err != nil {
+			return nil, fmt.Errorf("response_format.json_schema.schema: %v", err)
+		}
+		return f.JSONSchema.Schema, nil
+	default:
+		return nil, fmt.Errorf("unsupported response_format type %q", f.Type)
+	}
+}
+
+// strictSchema returns the schema the output must be validated against, if strict mode was requested.
+func (f *openAIResponseFormat) strictSchema() json.RawMessage {
+	if f == nil || f.Type != "json_schema" || f.JSONSchema == nil || !f.JSONSchema.Strict {
+		return nil
+	}
+	return f.JSONSchema.Schema
+}
+
+type openAIStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type openAIResponse struct {
@@ -42,8 +99,19 @@ type openAIChoice struct {
 }
 
 type openAIMessage struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role      string           `json:"role,omitempty"`
+	Content   string           `json:"content,omitempty"`
+	ToolCalls []openAIToolCall `json:"tool_calls,omitempty"`
+}
+
+type openAIToolCall struct {
+	Index    *int   `json:"index,omitempty"` // streaming deltas only
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"` // JSON-encoded string, unlike Ollama's object
+	} `json:"function"`
 }
 
 type openAIUsage struct {
@@ -70,10 +138,15 @@ func generateCompletionID() string {
 }
 
 // handleOpenAIChatCompletions handles POST /v1/chat/completions
-func handleOpenAIChatCompletions(db *DB, ollama *OllamaClient) http.HandlerFunc {
+func handleOpenAIChatCompletions(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req openAIRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			var cerr *contentError
+			if errors.As(err, &cerr) {
+				writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", cerr.Error())
+				return
+			}
 			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Could not parse request body.")
 			return
 		}
@@ -82,32 +155,89 @@ func handleOpenAIChatCompletions(db *DB, ollama *OllamaClient) http.HandlerFunc
 			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Missing required parameter: 'model'.")
 			return
 		}
+		if !modelPermitted(r.Context(), req.Model) {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", req.Model))
+			return
+		}
 		if len(req.Messages) == 0 {
 			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", "Missing required parameter: 'messages'.")
 			return
 		}
+		if _, err := req.ResponseFormat.ollamaFormat(); err != nil {
+			writeOpenAIError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+			return
+		}
+		targets, err := resolveChatTargets(r.Context(), db, req.Model)
+		if err != nil {
+			writeOpenAIError(w, http.StatusInternalServerError, "server_error", "Failed to resolve model.")
+			return
+		}
+		if len(targets) == 0 {
+			writeOpenAIError(w, http.StatusNotFound, "invalid_request_error", fmt.Sprintf("The model '%s' does not exist or you do not have access to it.", req.Model))
+			return
+		}
+		chatReq := buildChatRequest(&req)
+
+		ticket, err := inferenceQueue.EnqueueRequest(r)
+		if err != nil {
+			writeQueueRetryAfter(w)
+			writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Server is busy: "+err.Error()+". Please retry shortly.")
+			return
+		}
+		defer ticket.Release()
 
 		completionID := generateCompletionID()
 		created := time.Now().Unix()
 
+		var usage *openAIUsage
+		var start time.Time
 		if req.Stream {
-			handleOpenAIStream(w, ollama, &req, completionID, created)
+			start = time.Now()
+			usage, err = handleOpenAIStream(r.Context(), w, backend, ticket, targets, chatReq, &req, completionID, created)
 		} else {
-			handleOpenAINonStream(w, ollama, &req, completionID, created)
+			if err := ticket.Wait(nil); err != nil {
+				writeQueueRetryAfter(w)
+				writeOpenAIError(w, http.StatusServiceUnavailable, "server_error", "Server is busy: "+err.Error()+".")
+				return
+			}
+			start = time.Now()
+			usage, err = handleOpenAINonStream(r.Context(), w, backend, targets, chatReq, &req, completionID, created)
 		}
+		if isQueueError(err) {
+			return
+		}
+		if usage == nil {
+			usage = newOpenAIUsage(0, 0)
+		}
+		recordUsage(db, r, req.Model, start, usage.PromptTokens, usage.CompletionTokens, err)
 	}
 }
 
-func handleOpenAINonStream(w http.ResponseWriter, ollama *OllamaClient, req *openAIRequest, id string, created int64) {
-	opts := buildOllamaOptions(req)
-	resp, err := ollama.Chat(req.Model, req.Messages, opts)
+// handleOpenAINonStream writes a chat.completion response and returns the token usage it reported.
+// req.Model is updated to the model that served the call.
+func handleOpenAINonStream(ctx context.Context, w http.ResponseWriter, backend Backend, targets chatTargets, chatReq ChatRequest, req *openAIRequest, id string, created int64) (*openAIUsage, error) {
+	resp, served, err := targets.Chat(ctx, backend, chatReq)
+	req.Model = served
 	if err != nil {
-		log.Printf("Ollama error: %v", err)
+		log.Printf("Inference error: %v", err)
 		writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("Model inference failed: %v", err))
-		return
+		return nil, err
+	}
+
+	usage := newOpenAIUsage(resp.PromptTokens, resp.CompletionTokens)
+	// A tool-call turn has no content to validate; the schema applies to the final answer.
+	if schema := req.ResponseFormat.strictSchema(); schema != nil && len(resp.Message.ToolCalls) == 0 {
+		if err := validateJSONSchema(schema, []byte(resp.Message.Content)); err != nil {
+			writeOpenAIError(w, http.StatusBadGateway, "server_error", fmt.Sprintf("Model output does not conform to the requested JSON schema: %v", err))
+			return usage, err
+		}
 	}
 
 	finishReason := "stop"
+	toolCalls := toOpenAIToolCalls(resp.Message.ToolCalls)
+	if len(toolCalls) > 0 {
+		finishReason = "tool_calls"
+	}
 	result := openAIResponse{
 		ID:      id,
 		Object:  "chat.completion",
@@ -116,55 +246,92 @@ func handleOpenAINonStream(w http.ResponseWriter, ollama *OllamaClient, req *ope
 		Choices: []openAIChoice{
 			{
 				Index:        0,
-				Message:      &openAIMessage{Role: "assistant", Content: resp.Message.Content},
+				Message:      &openAIMessage{Role: "assistant", Content: resp.Message.Content, ToolCalls: toolCalls},
 				FinishReason: &finishReason,
 			},
 		},
-		Usage: &openAIUsage{
-			PromptTokens:     0,
-			CompletionTokens: 0,
-			TotalTokens:      0,
-		},
+		Usage: usage,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(result)
+	return result.Usage, nil
 }
 
-func handleOpenAIStream(w http.ResponseWriter, ollama *OllamaClient, req *openAIRequest, id string, created int64) {
+// handleOpenAIStream writes chat.completion.chunk events and returns the token usage of the generation.
+// req.Model is updated to the model that served the call.
+func handleOpenAIStream(ctx context.Context, w http.ResponseWriter, backend Backend, ticket *queueTicket, targets chatTargets, chatReq ChatRequest, req *openAIRequest, id string, created int64) (*openAIUsage, error) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		writeOpenAIError(w, http.StatusInternalServerError, "server_error", "Streaming not supported.")
-		return
+		return nil, fmt.Errorf("streaming not supported")
 	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	// First chunk: send the role
-	firstChunk := openAIResponse{
-		ID:      id,
-		Object:  "chat.completion.chunk",
-		Created: created,
-		Model:   req.Model,
-		Choices: []openAIChoice{
-			{
-				Index:        0,
-				Delta:        &openAIMessage{Role: "assistant"},
-				FinishReason: nil,
-			},
-		},
+	// Queue position goes out as SSE comments, which OpenAI clients ignore
+	err := ticket.Wait(func(position int) {
+		fmt.Fprintf(w, ": queued %d\n\n", position)
+		flusher.Flush()
+	})
+	if err != nil {
+		errJSON, _ := json.Marshal(map[string]any{
+			"error": map[string]any{"message": "Server is busy: " + err.Error() + ".", "type": "server_error"},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", errJSON)
+		flusher.Flush()
+		return nil, err
 	}
-	data, _ := json.Marshal(firstChunk)
-	fmt.Fprintf(w, "data: %s\n\n", data)
-	flusher.Flush()
 
-	opts := buildOllamaOptions(req)
+	// First chunk: send the role. It waits for the model's first output so
+	// that it names the model a fallback chain settled on.
+	sentRole := false
+	sendRole := func() {
+		firstChunk := openAIResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openAIChoice{
+				{
+					Index:        0,
+					Delta:        &openAIMessage{Role: "assistant"},
+					FinishReason: nil,
+				},
+			},
+		}
+		data, _ := json.Marshal(firstChunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+		sentRole = true
+	}
 
-	err := ollama.ChatStream(req.Model, req.Messages, opts, func(chunk StreamChunk) error {
+	var usage *openAIUsage
+	var content strings.Builder
+	toolCallCount := 0
+	served, err := targets.ChatStream(ctx, backend, chatReq, func(model string, chunk StreamChunk) error {
+		if !sentRole {
+			req.Model = model
+			sendRole()
+		}
+		content.WriteString(chunk.Content)
 		if chunk.Done {
-			return nil
+			usage = newOpenAIUsage(chunk.PromptTokens, chunk.CompletionTokens)
+			if chunk.Content == "" && len(chunk.ToolCalls) == 0 {
+				return nil
+			}
+		}
+
+		delta := &openAIMessage{Content: chunk.Content}
+		if len(chunk.ToolCalls) > 0 {
+			delta.ToolCalls = toOpenAIToolCalls(chunk.ToolCalls)
+			for i := range delta.ToolCalls {
+				idx := toolCallCount + i
+				delta.ToolCalls[i].Index = &idx
+			}
+			toolCallCount += len(delta.ToolCalls)
 		}
 
 		streamChunk := openAIResponse{
@@ -175,7 +342,7 @@ func handleOpenAIStream(w http.ResponseWriter, ollama *OllamaClient, req *openAI
 			Choices: []openAIChoice{
 				{
 					Index:        0,
-					Delta:        &openAIMessage{Content: chunk.Content},
+					Delta:        delta,
 					FinishReason: nil,
 				},
 			},
@@ -186,13 +353,37 @@ func handleOpenAIStream(w http.ResponseWriter, ollama *OllamaClient, req *openAI
 		return nil
 	})
 
+	req.Model = served
 	if err != nil {
 		log.Printf("Stream error: %v", err)
-		return
+		return usage, err
+	}
+	if !sentRole {
+		sendRole()
 	}
 
-	// Final chunk: finish_reason = "stop"
+	// Strict structured output can only be checked once the whole answer is in.
+	// The content has already been streamed, so report the failure as an error event.
+	// Tool-call turns carry no answer to validate.
+	if schema := req.ResponseFormat.strictSchema(); schema != nil && toolCallCount == 0 {
+		if err := validateJSONSchema(schema, []byte(content.String())); err != nil {
+			errJSON, _ := json.Marshal(map[string]any{
+				"error": map[string]any{
+					"message": fmt.Sprintf("Model output does not conform to the requested JSON schema: %v", err),
+					"type":    "server_error",
+				},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", errJSON)
+			flusher.Flush()
+			return usage, err
+		}
+	}
+
+	// Final chunk: finish_reason = "stop", or "tool_calls" if the model called a tool
 	finishReason := "stop"
+	if toolCallCount > 0 {
+		finishReason = "tool_calls"
+	}
 	finalChunk := openAIResponse{
 		ID:      id,
 		Object:  "chat.completion.chunk",
@@ -206,25 +397,44 @@ func handleOpenAIStream(w http.ResponseWriter, ollama *OllamaClient, req *openAI
 			},
 		},
 	}
-	data, _ = json.Marshal(finalChunk)
+	data, _ := json.Marshal(finalChunk)
 	fmt.Fprintf(w, "data: %s\n\n", data)
 	flusher.Flush()
 
+	// stream_options.include_usage: one extra chunk with empty choices and the totals
+	if req.StreamOptions != nil && req.StreamOptions.IncludeUsage {
+		if usage == nil {
+			usage = newOpenAIUsage(0, 0)
+		}
+		usageChunk := openAIResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openAIChoice{},
+			Usage:   usage,
+		}
+		data, _ = json.Marshal(usageChunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
 	fmt.Fprint(w, "data: [DONE]\n\n")
 	flusher.Flush()
+	return usage, nil
 }
 
 // handleOpenAIListModels handles GET /v1/models
-func handleOpenAIListModels(ollama *OllamaClient) http.HandlerFunc {
+func handleOpenAIListModels(db *DB, backend Backend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		models, err := ollama.ListModels()
+		models, err := listAllModels(db, backend)
 		if err != nil {
 			writeOpenAIError(w, http.StatusBadGateway, "server_error", "Failed to list models.")
 			return
 		}
 
 		var data []openAIModel
-		for _, m := range models {
+		for _, m := range permittedModels(r.Context(), models) {
 			data = append(data, openAIModel{
 				ID:      m.Name,
 				Object:  "model",
@@ -241,6 +451,14 @@ func handleOpenAIListModels(ollama *OllamaClient) http.HandlerFunc {
 	}
 }
 
+func newOpenAIUsage(promptTokens, completionTokens int) *openAIUsage {
+	return &openAIUsage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
 func writeOpenAIError(w http.ResponseWriter, status int, errType, message string) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
@@ -252,6 +470,102 @@ func writeOpenAIError(w http.ResponseWriter, status int, errType, message string
 	})
 }
 
+// buildChatRequest converts an OpenAI chat request into the Ollama chat call.
+func buildChatRequest(req *openAIRequest) ChatRequest {
+	format, _ := req.ResponseFormat.ollamaFormat() // validated by the handler
+	return ChatRequest{
+		Model:    req.Model,
+		Messages: toOllamaMessages(req.Messages),
+		Options:  buildOllamaOptions(req),
+		Tools:    selectTools(req.Tools, req.ToolChoice),
+		Format:   format,
+	}
+}
+
+// toOllamaMessages adapts OpenAI tool-calling messages to Ollama's format:
+// tool call arguments become JSON objects, and "tool" results are labelled
+// with the function name that their tool_call_id refers to. Call IDs are
+// kept so an OpenAI-compatible backend sees the ones the client sent.
+func toOllamaMessages(messages []ChatMessage) []ChatMessage {
+	callNames := make(map[string]string)
+	out := make([]ChatMessage, len(messages))
+	for i, m := range messages {
+		if len(m.ToolCalls) > 0 {
+			calls := make([]ToolCall, len(m.ToolCalls))
+			for j, tc := range m.ToolCalls {
+				calls[j] = ToolCall{ID: tc.ID, Function: ToolCallFunction{
+					Name:      tc.Function.Name,
+					Arguments: argumentsObject(tc.Function.Arguments),
+				}}
+				if tc.ID != "" {
+					callNames[tc.ID] = tc.Function.Name
+				}
+			}
+			m.ToolCalls = calls
+		}
+		if m.Role == "tool" && m.ToolName == "" {
+			m.ToolName = callNames[m.ToolCallID]
+		}
+		out[i] = m
+	}
+	return out
+}
+
+// argumentsObject unwraps OpenAI's JSON-string arguments into the raw object Ollama expects.
+func argumentsObject(raw json.RawMessage) json.RawMessage {
+	var encoded string
+	if err := json.Unmarshal(raw, &encoded); err == nil {
+		raw = json.RawMessage(encoded)
+	}
+	if len(raw) == 0 || !json.Valid(raw) {
+		return json.RawMessage("{}")
+	}
+	return raw
+}
+
+// toOpenAIToolCalls converts Ollama tool calls into OpenAI's shape, assigning call IDs.
+func toOpenAIToolCalls(calls []ToolCall) []openAIToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]openAIToolCall, len(calls))
+	for i, tc := range calls {
+		id := tc.ID
+		if id == "" {
+			suffix, _ := randomHex(12)
+			id = "call_" + suffix
+		}
+		out[i].ID = id
+		out[i].Type = "function"
+		out[i].Function.Name = tc.Function.Name
+		out[i].Function.Arguments = string(argumentsObject(tc.Function.Arguments))
+	}
+	return out
+}
+
+// selectTools applies tool_choice to the tool list. Ollama has no tool_choice,
+// so "none" drops the tools and a named function narrows the list to that one.
+func selectTools(tools []Tool, choice any) []Tool {
+	switch c := choice.(type) {
+	case string:
+		if c == "none" {
+			return nil
+		}
+	case map[string]any:
+		fn, _ := c["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		if name == "" {
+			return tools
+		}
+		for _, t := range tools {
+			if t.Function.Name == name {
+				return []Tool{t}
+			}
+		}
+	}
+	return tools
+}
+
 // buildOllamaOptions translates OpenAI API parameters into the specific tuning options that Ollama's engine expects.
 // Ollama maps most of these 1:1, but uses 'num_predict' instead of 'max_tokens'.
 func buildOllamaOptions(req *openAIRequest) map[string]any {
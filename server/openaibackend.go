@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// OpenAIBackend talks to an OpenAI-compatible inference server
+// (llama.cpp's llama-server, vLLM, LM Studio, ...). BaseURL includes the
+// API prefix, e.g. "http://gpu-box:8000/v1".
+type OpenAIBackend struct {
+	BaseURL    string
+	APIKey     string // optional; sent as a Bearer token
+	HTTPClient *http.Client
+}
+
+func NewOpenAIBackend(baseURL, apiKey string) *OpenAIBackend {
+	return &OpenAIBackend{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		APIKey:  apiKey,
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+func (b *OpenAIBackend) String() string {
+	return "OpenAI-compatible server at " + b.BaseURL
+}
+
+// ListModels returns the models the upstream serves. OpenAI's model list
+// carries no size or family details, so only the name and date are set.
+func (b *OpenAIBackend) ListModels() ([]Model, error) {
+	req, err := http.NewRequest("GET", b.BaseURL+"/models", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := b.do(b.HTTPClient, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result openAIModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding upstream response: %w", err)
+	}
+	models := make([]Model, len(result.Data))
+	for i, m := range result.Data {
+		models[i] = Model{Name: m.ID, Model: m.ID, ModifiedAt: time.Unix(m.Created, 0).UTC()}
+	}
+	return models, nil
+}
+
+// ListRunningModels reports every served model: OpenAI-compatible servers
+// keep their models loaded for as long as they run.
+func (b *OpenAIBackend) ListRunningModels() ([]RunningModel, error) {
+	models, err := b.ListModels()
+	if err != nil {
+		return nil, err
+	}
+	running := make([]RunningModel, len(models))
+	for i, m := range models {
+		running[i] = RunningModel{Name: m.Name}
+	}
+	return running, nil
+}
+
+func (b *OpenAIBackend) PullModelStream(ctx context.Context, name string, onLine func([]byte) error) error {
+	return errBackendUnsupported
+}
+
+func (b *OpenAIBackend) DeleteModel(name string) error {
+	return errBackendUnsupported
+}
+
+// Chat sends a non-streaming chat completion request upstream.
+func (b *OpenAIBackend) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	httpReq, err := b.chatRequest(ctx, req, false)
+	if err != nil {
+		return nil, err
+	}
+	// No timeout for inference -- it can take a while on slower hardware
+	resp, err := b.do(&http.Client{Timeout: 0}, httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result openAIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding upstream response: %w", err)
+	}
+	if len(result.Choices) == 0 || result.Choices[0].Message == nil {
+		return nil, fmt.Errorf("upstream returned no choices")
+	}
+
+	choice := result.Choices[0]
+	out := &ChatResponse{
+		Model: req.Model,
+		Message: ChatMessage{
+			Role:      "assistant",
+			Content:   choice.Message.Content,
+			ToolCalls: fromOpenAIToolCalls(choice.Message.ToolCalls),
+		},
+		DoneReason: upstreamDoneReason(choice.FinishReason),
+	}
+	if result.Usage != nil {
+		out.PromptTokens = result.Usage.PromptTokens
+		out.CompletionTokens = result.Usage.CompletionTokens
+	}
+	return out, nil
+}
+
+// ChatStream sends a streaming chat completion request upstream. Content
+// deltas are forwarded as they arrive; tool call fragments are assembled and
+// delivered on the final chunk together with the finish reason and usage.
+func (b *OpenAIBackend) ChatStream(ctx context.Context, req ChatRequest, onChunk func(StreamChunk) error) error {
+	httpReq, err := b.chatRequest(ctx, req, true)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do(&http.Client{Timeout: 0}, httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	final := StreamChunk{Done: true, DoneReason: "stop"}
+	calls := make(map[int]*openAIToolCall)
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+
+		var chunk openAIResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			continue
+		}
+		if chunk.Usage != nil {
+			final.PromptTokens = chunk.Usage.PromptTokens
+			final.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+
+		choice := chunk.Choices[0]
+		if choice.FinishReason != nil {
+			final.DoneReason = upstreamDoneReason(choice.FinishReason)
+		}
+		if choice.Delta == nil {
+			continue
+		}
+		for i, tc := range choice.Delta.ToolCalls {
+			idx := i
+			if tc.Index != nil {
+				idx = *tc.Index
+			}
+			call, ok := calls[idx]
+			if !ok {
+				call = &openAIToolCall{}
+				calls[idx] = call
+			}
+			if tc.ID != "" {
+				call.ID = tc.ID
+			}
+			call.Function.Name += tc.Function.Name
+			call.Function.Arguments += tc.Function.Arguments
+		}
+		if choice.Delta.Content != "" {
+			if err := onChunk(StreamChunk{Content: choice.Delta.Content}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	indexes := make([]int, 0, len(calls))
+	for idx := range calls {
+		indexes = append(indexes, idx)
+	}
+	sort.Ints(indexes)
+	assembled := make([]openAIToolCall, len(indexes))
+	for i, idx := range indexes {
+		assembled[i] = *calls[idx]
+	}
+	final.ToolCalls = fromOpenAIToolCalls(assembled)
+	return onChunk(final)
+}
+
+// Embed calls the upstream /embeddings endpoint.
+func (b *OpenAIBackend) Embed(ctx context.Context, model string, input []string, dimensions int) (*EmbedResponse, error) {
+	payload := map[string]any{"model": model, "input": input}
+	if dimensions > 0 {
+		payload["dimensions"] = dimensions
+	}
+	body, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", b.BaseURL+"/embeddings", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.do(&http.Client{Timeout: 0}, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Model string `json:"model"`
+		Data  []struct {
+			Index     int       `json:"index"`
+			Embedding []float32 `json:"embedding"`
+		} `json:"data"`
+		Usage *openAIUsage `json:"usage"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decoding upstream response: %w", err)
+	}
+	out := &EmbedResponse{Model: result.Model, Embeddings: make([][]float32, len(input))}
+	for _, d := range result.Data {
+		if d.Index >= 0 && d.Index < len(out.Embeddings) {
+			out.Embeddings[d.Index] = d.Embedding
+		}
+	}
+	if result.Usage != nil {
+		out.PromptTokens = result.Usage.PromptTokens
+	}
+	return out, nil
+}
+
+// do sends req with the upstream API key and turns non-200 responses into errors.
+func (b *OpenAIBackend) do(client *http.Client, req *http.Request) (*http.Response, error) {
+	if b.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+b.APIKey)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to upstream: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("upstream returned %d: %s", resp.StatusCode, body)
+	}
+	return resp, nil
+}
+
+// chatRequest builds the upstream /chat/completions request, mapping Ollama
+// options back to OpenAI's top-level sampling fields.
+func (b *OpenAIBackend) chatRequest(ctx context.Context, req ChatRequest, stream bool) (*http.Request, error) {
+	payload := map[string]any{
+		"model":    req.Model,
+		"messages": toUpstreamMessages(req.Messages),
+		"stream":   stream,
+	}
+	if stream {
+		payload["stream_options"] = openAIStreamOptions{IncludeUsage: true}
+	}
+	optionNames := map[string]string{
+		"temperature":       "temperature",
+		"top_p":             "top_p",
+		"num_predict":       "max_tokens",
+		"stop":              "stop",
+		"seed":              "seed",
+		"frequency_penalty": "frequency_penalty",
+		"presence_penalty":  "presence_penalty",
+	}
+	for ollamaName, openAIName := range optionNames {
+		if v, ok := req.Options[ollamaName]; ok {
+			payload[openAIName] = v
+		}
+	}
+	if len(req.Tools) > 0 {
+		payload["tools"] = req.Tools
+	}
+	if len(req.Format) > 0 {
+		if string(req.Format) == `"json"` {
+			payload["response_format"] = map[string]string{"type": "json_object"}
+		} else {
+			payload["response_format"] = map[string]any{
+				"type":        "json_schema",
+				"json_schema": map[string]any{"name": "response", "schema": req.Format},
+			}
+		}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling request: %w", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", b.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	return httpReq, nil
+}
+
+// upstreamMessage is a chat message in OpenAI's wire format.
+type upstreamMessage struct {
+	Role       string           `json:"role"`
+	Content    any              `json:"content"` // string, or content parts when images are attached
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+}
+
+// toUpstreamMessages is the inverse of toOllamaMessages: images become
+// image_url content parts, and tool results that only carry a function
+// name are matched to the ID of the call that requested it.
+func toUpstreamMessages(messages []ChatMessage) []upstreamMessage {
+	callIDs := make(map[string]string)
+	out := make([]upstreamMessage, len(messages))
+	for i, m := range messages {
+		um := upstreamMessage{Role: m.Role, Content: m.Content, ToolCallID: m.ToolCallID}
+		if len(m.Images) > 0 {
+			parts := []map[string]any{{"type": "text", "text": m.Content}}
+			for _, img := range m.Images {
+				parts = append(parts, map[string]any{
+					"type":      "image_url",
+					"image_url": map[string]string{"url": imageDataURL(img)},
+				})
+			}
+			um.Content = parts
+		}
+		if len(m.ToolCalls) > 0 {
+			um.ToolCalls = toOpenAIToolCalls(m.ToolCalls)
+			for _, tc := range um.ToolCalls {
+				callIDs[tc.Function.Name] = tc.ID
+			}
+		}
+		if m.Role == "tool" && um.ToolCallID == "" {
+			um.ToolCallID = callIDs[m.ToolName]
+		}
+		out[i] = um
+	}
+	return out
+}
+
+// fromOpenAIToolCalls converts OpenAI tool calls (string arguments) to ChatMessage tool calls.
+func fromOpenAIToolCalls(calls []openAIToolCall) []ToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]ToolCall, len(calls))
+	for i, tc := range calls {
+		out[i] = ToolCall{
+			ID:   tc.ID,
+			Type: "function",
+			Function: ToolCallFunction{
+				Name:      tc.Function.Name,
+				Arguments: argumentsObject(json.RawMessage(tc.Function.Arguments)),
+			},
+		}
+	}
+	return out
+}
+
+// upstreamDoneReason maps an OpenAI finish_reason onto Ollama's done_reason.
+// Tool calls are reported through the message itself, so they map to "stop".
+func upstreamDoneReason(finishReason *string) string {
+	if finishReason != nil && *finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// imageDataURL wraps base64 image bytes in a data URL with a sniffed MIME type.
+func imageDataURL(b64 string) string {
+	head, _ := base64.StdEncoding.DecodeString(b64[:min(len(b64), 684)/4*4])
+	return "data:" + http.DetectContentType(head) + ";base64," + b64
+}
@@ -35,7 +35,7 @@ func pauseMiddleware(db *DB, next http.Handler) http.Handler {
 
 		// Allow essential paths even when paused for remote users:
 		// - SPA and static assets (so users see the paused message in-app)
-		// - Auth endpoints (so sessions still work)
+		// - Auth endpoints, every sign-in method included (so sessions still work)
 		// - Status endpoint (so frontend knows why it's blocked)
 		// - Health check
 		path := r.URL.Path
@@ -44,6 +44,12 @@ func pauseMiddleware(db *DB, next http.Handler) http.Handler {
 			path == "/health" ||
 			path == "/api/setup/status" ||
 			path == "/api/auth/login" ||
+			path == "/api/auth/login/2fa" ||
+			path == "/api/auth/passkeys/login/begin" ||
+			path == "/api/auth/passkeys/login/finish" ||
+			path == "/api/auth/oidc" ||
+			path == "/api/auth/oidc/login" ||
+			path == "/api/auth/oidc/callback" ||
 			path == "/api/auth/logout" ||
 			path == "/api/auth/me" ||
 			path == "/api/status" {
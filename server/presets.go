@@ -0,0 +1,345 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Preset is a virtual model: a base model plus a locked system prompt and
+// hidden few-shot examples, with default sampling parameters. Clients call it
+// by name like any other model and never see the expanded request. A preset
+// shadows a real model with the same name.
+type Preset struct {
+	ID           int           `json:"id"`
+	Name         string        `json:"name"`
+	BaseModel    string        `json:"base_model"`
+	SystemPrompt string        `json:"system_prompt,omitempty"`
+	Temperature  *float64      `json:"temperature,omitempty"` // default; clients may override
+	NumCtx       *int          `json:"num_ctx,omitempty"`     // default; clients may override
+	Examples     []ChatMessage `json:"examples,omitempty"`    // few-shot messages inserted after the system prompt
+	CreatedAt    time.Time     `json:"created_at"`
+	UpdatedAt    time.Time     `json:"updated_at"`
+}
+
+// apply rewrites a chat request for the preset's base model. Client system
+// messages are dropped so they cannot override the preset's. A nil preset
+// leaves the request unchanged.
+func (p *Preset) apply(req *ChatRequest) {
+	if p == nil {
+		return
+	}
+	req.Model = p.BaseModel
+
+	messages := make([]ChatMessage, 0, len(p.Examples)+len(req.Messages)+1)
+	if p.SystemPrompt != "" {
+		messages = append(messages, ChatMessage{Role: "system", Content: p.SystemPrompt})
+	}
+	messages = append(messages, p.Examples...)
+	for _, m := range req.Messages {
+		if m.Role != "system" {
+			messages = append(messages, m)
+		}
+	}
+	req.Messages = messages
+
+	if p.Temperature == nil && p.NumCtx == nil {
+		return
+	}
+	if req.Options == nil {
+		req.Options = make(map[string]any)
+	}
+	if _, set := req.Options["temperature"]; !set && p.Temperature != nil {
+		req.Options["temperature"] = *p.Temperature
+	}
+	if _, set := req.Options["num_ctx"]; !set && p.NumCtx != nil {
+		req.Options["num_ctx"] = *p.NumCtx
+	}
+}
+
+func (p *Preset) validate() error {
+	if strings.TrimSpace(p.Name) == "" || strings.TrimSpace(p.BaseModel) == "" {
+		return fmt.Errorf("name and base_model are required")
+	}
+	if p.Temperature != nil && (*p.Temperature < 0 || *p.Temperature > 2) {
+		return fmt.Errorf("temperature must be between 0 and 2")
+	}
+	if p.NumCtx != nil && *p.NumCtx <= 0 {
+		return fmt.Errorf("num_ctx must be positive")
+	}
+	for i, m := range p.Examples {
+		if m.Role != "user" && m.Role != "assistant" {
+			return fmt.Errorf("examples.%d.role: must be 'user' or 'assistant'", i)
+		}
+	}
+	return nil
+}
+
+// --- Database methods ---
+
+const presetColumns = `id, name, base_model, system_prompt, temperature, num_ctx, examples, created_at, updated_at`
+
+func scanPreset(row interface{ Scan(...any) error }) (*Preset, error) {
+	var p Preset
+	var system, examples sql.NullString
+	if err := row.Scan(&p.ID, &p.Name, &p.BaseModel, &system, &p.Temperature, &p.NumCtx, &examples, &p.CreatedAt, &p.UpdatedAt); err != nil {
+		return nil, err
+	}
+	p.SystemPrompt = system.String
+	if examples.Valid && examples.String != "" {
+		if err := json.Unmarshal([]byte(examples.String), &p.Examples); err != nil {
+			return nil, fmt.Errorf("decoding examples of preset %q: %w", p.Name, err)
+		}
+	}
+	return &p, nil
+}
+
+// encodeExamples converts few-shot examples to their column value (NULL when there are none).
+func encodeExamples(examples []ChatMessage) any {
+	if len(examples) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(examples)
+	return string(b)
+}
+
+// CreatePreset stores a new preset.
+func (db *DB) CreatePreset(p *Preset) error {
+	result, err := db.conn.Exec(`
+		INSERT INTO model_presets (name, base_model, system_prompt, temperature, num_ctx, examples)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, p.Name, p.BaseModel, p.SystemPrompt, p.Temperature, p.NumCtx, encodeExamples(p.Examples))
+	if err != nil {
+		return fmt.Errorf("inserting preset: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	p.ID = int(id)
+	p.CreatedAt = time.Now().UTC()
+	p.UpdatedAt = p.CreatedAt
+	return nil
+}
+
+// UpdatePreset replaces every field of an existing preset.
+func (db *DB) UpdatePreset(p *Preset) error {
+	result, err := db.conn.Exec(`
+		UPDATE model_presets
+		SET name = ?, base_model = ?, system_prompt = ?, temperature = ?, num_ctx = ?, examples = ?, updated_at = CURRENT_TIMESTAMP
+		WHERE id = ?
+	`, p.Name, p.BaseModel, p.SystemPrompt, p.Temperature, p.NumCtx, encodeExamples(p.Examples), p.ID)
+	if err != nil {
+		return fmt.Errorf("updating preset: %w", err)
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetPreset looks up a preset by the model name a client asked for. Returns
+// nil if there is no such preset.
+func (db *DB) GetPreset(model string) (*Preset, error) {
+	p, err := scanPreset(db.conn.QueryRow(`
+		SELECT `+presetColumns+` FROM model_presets WHERE name = ? OR name || ':latest' = ?
+	`, model, model))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// chatOnlyModel explains why model can't be used outside chat completions,
+// or returns "" if it can. Presets and aliases are only expanded on the chat
+// paths; anywhere else their name would reach the backend as is and fail there.
+func chatOnlyModel(db *DB, model string) (string, error) {
+	preset, err := db.GetPreset(model)
+	if err != nil {
+		return "", err
+	}
+	if preset != nil {
+		return fmt.Sprintf("'%s' is a preset and can only be used with chat completions; call '%s' directly instead.", model, preset.BaseModel), nil
+	}
+	alias, err := db.GetAlias(model)
+	if err != nil {
+		return "", err
+	}
+	if alias != nil {
+		return fmt.Sprintf("'%s' is an alias and can only be used with chat completions; call one of its models directly instead.", model), nil
+	}
+	return "", nil
+}
+
+// ListPresets returns all presets ordered by name.
+func (db *DB) ListPresets() ([]Preset, error) {
+	rows, err := db.conn.Query(`SELECT ` + presetColumns + ` FROM model_presets ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var presets []Preset
+	for rows.Next() {
+		p, err := scanPreset(rows)
+		if err != nil {
+			return nil, err
+		}
+		presets = append(presets, *p)
+	}
+	return presets, rows.Err()
+}
+
+// DeletePreset removes a preset.
+func (db *DB) DeletePreset(id int) error {
+	result, err := db.conn.Exec(`DELETE FROM model_presets WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// listAllModels returns the backend's models followed by every preset and
+// alias, each reported with the details of the model it resolves to.
+func listAllModels(db *DB, backend Backend) ([]Model, error) {
+	models, err := backend.ListModels()
+	if err != nil {
+		return nil, err
+	}
+	presets, err := db.ListPresets()
+	if err != nil {
+		return nil, err
+	}
+	aliases, err := db.ListAliases()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]Model, len(models)+len(presets))
+	for _, m := range models {
+		byName[normalizeModelName(m.Name)] = m
+	}
+	for _, p := range presets {
+		m := byName[normalizeModelName(p.BaseModel)]
+		m.Name = p.Name
+		m.Model = p.BaseModel
+		m.ModifiedAt = p.UpdatedAt
+		models = append(models, m)
+		byName[normalizeModelName(p.Name)] = m
+	}
+	for _, a := range aliases {
+		var m Model
+		for _, target := range a.Targets {
+			if found, ok := byName[normalizeModelName(target)]; ok {
+				m = found
+				break
+			}
+		}
+		m.Name = a.Name
+		m.Model = a.Targets[0]
+		m.ModifiedAt = a.UpdatedAt
+		models = append(models, m)
+	}
+	return models, nil
+}
+
+// --- HTTP handlers ---
+
+// handleListPresets handles GET /api/admin/presets
+func handleListPresets(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		presets, err := db.ListPresets()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list presets"})
+			return
+		}
+		if presets == nil {
+			presets = []Preset{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"presets": presets})
+	}
+}
+
+// handleCreatePreset handles POST /api/admin/presets
+func handleCreatePreset(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var p Preset
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := p.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		if err := db.CreatePreset(&p); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("failed to create preset: %v", err)})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"preset": p})
+	}
+}
+
+// handleUpdatePreset handles PUT /api/admin/presets/{id}
+func handleUpdatePreset(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid preset ID"})
+			return
+		}
+
+		var p Preset
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if err := p.validate(); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		p.ID = id
+		if err := db.UpdatePreset(&p); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "preset not found"})
+				return
+			}
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("failed to update preset: %v", err)})
+			return
+		}
+		updated, err := db.GetPreset(p.Name)
+		if err != nil || updated == nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "preset updated but could not be reloaded"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"preset": updated})
+	}
+}
+
+// handleDeletePreset handles DELETE /api/admin/presets/{id}
+func handleDeletePreset(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid preset ID"})
+			return
+		}
+
+		if err := db.DeletePreset(id); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "preset not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete preset"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
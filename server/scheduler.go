@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Scheduler bounds how many inference calls run against the backend at once.
+// Callers beyond the limit wait in per-user FIFO queues that are served
+// round-robin, so one user's burst cannot starve everyone else.
+type Scheduler struct {
+	limit    int           // concurrent inference calls; 0 = unlimited
+	maxQueue int           // waiting calls before new ones are rejected; 0 = unlimited
+	maxWait  time.Duration // longest a call may wait for a slot; 0 = forever
+
+	mu      sync.Mutex
+	running int
+	waiting int
+	queues  map[int][]*queueTicket // user ID -> waiting tickets, oldest first
+	order   []int                  // users with waiting tickets, in round-robin order
+}
+
+// queueTicket is one inference call's place in the scheduler.
+type queueTicket struct {
+	s        *Scheduler
+	ctx      context.Context
+	user     int
+	ready    chan struct{} // closed when a slot is granted
+	position chan int      // latest queue position (1 = next), buffered
+	granted  bool
+	released bool
+}
+
+var (
+	errQueueFull      = errors.New("the inference queue is full")
+	errQueueTimeout   = errors.New("timed out waiting in the inference queue")
+	errQueueCancelled = errors.New("request cancelled while waiting in the inference queue")
+)
+
+// queueRetryAfter is the Retry-After hint sent when a call cannot be queued.
+const queueRetryAfter = 10 * time.Second
+
+// inferenceQueue schedules all chat and completion calls. main replaces it
+// with one configured from flags; the zero configuration is unlimited.
+var inferenceQueue = NewScheduler(0, 0, 0)
+
+func NewScheduler(limit, maxQueue int, maxWait time.Duration) *Scheduler {
+	return &Scheduler{
+		limit:    limit,
+		maxQueue: maxQueue,
+		maxWait:  maxWait,
+		queues:   make(map[int][]*queueTicket),
+	}
+}
+
+// Enqueue claims a slot for userID, or a place in the queue if all slots are
+// busy. It fails immediately with errQueueFull when the queue is at capacity.
+// The caller must Release the ticket when the inference call finishes.
+func (s *Scheduler) Enqueue(ctx context.Context, userID int) (*queueTicket, error) {
+	t := &queueTicket{s: s, ctx: ctx, user: userID, ready: make(chan struct{}), position: make(chan int, 1)}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.limit <= 0 || (s.running < s.limit && len(s.order) == 0) {
+		s.grant(t)
+		return t, nil
+	}
+	if s.maxQueue > 0 && s.waiting >= s.maxQueue {
+		return nil, errQueueFull
+	}
+
+	if len(s.queues[userID]) == 0 {
+		s.order = append(s.order, userID)
+	}
+	s.queues[userID] = append(s.queues[userID], t)
+	s.waiting++
+	s.notifyPositions()
+	return t, nil
+}
+
+// EnqueueRequest enqueues an inference call on behalf of the request's user.
+func (s *Scheduler) EnqueueRequest(r *http.Request) (*queueTicket, error) {
+	userID := 0
+	if user := UserFromContext(r.Context()); user != nil {
+		userID = user.ID
+	}
+	return s.Enqueue(r.Context(), userID)
+}
+
+// Wait blocks until the ticket is granted a slot. While queued, onQueued (if
+// non-nil) is called from the waiting goroutine whenever the position changes.
+func (t *queueTicket) Wait(onQueued func(position int)) error {
+	var timeout <-chan time.Time
+	if t.s.maxWait > 0 {
+		timer := time.NewTimer(t.s.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		case pos := <-t.position:
+			if onQueued != nil {
+				onQueued(pos)
+			}
+		case <-timeout:
+			if t.s.abandon(t) {
+				return errQueueTimeout
+			}
+			return nil
+		case <-t.ctx.Done():
+			if t.s.abandon(t) {
+				return errQueueCancelled
+			}
+			return nil
+		}
+	}
+}
+
+// Release frees the ticket's slot (or its place in the queue). It is safe to
+// call more than once.
+func (t *queueTicket) Release() {
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if t.released {
+		return
+	}
+	t.released = true
+	if !t.granted {
+		s.remove(t)
+		s.notifyPositions()
+		return
+	}
+	if s.limit > 0 {
+		s.running--
+		s.dispatch()
+	}
+}
+
+// Stats reports the number of running and waiting calls.
+func (s *Scheduler) Stats() (running, waiting int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, s.waiting
+}
+
+// abandon removes a ticket that stopped waiting. It returns false if the
+// ticket was granted in the meantime, in which case the caller owns the slot.
+func (s *Scheduler) abandon(t *queueTicket) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.granted {
+		return false
+	}
+	t.released = true
+	s.remove(t)
+	s.notifyPositions()
+	return true
+}
+
+// grant gives t a slot. Caller holds s.mu.
+func (s *Scheduler) grant(t *queueTicket) {
+	t.granted = true
+	if s.limit > 0 {
+		s.running++
+	}
+	close(t.ready)
+}
+
+// dispatch hands free slots to waiting tickets, one user at a time. Caller holds s.mu.
+func (s *Scheduler) dispatch() {
+	for s.running < s.limit && len(s.order) > 0 {
+		user := s.order[0]
+		s.order = s.order[1:]
+		queue := s.queues[user]
+		t := queue[0]
+		if len(queue) > 1 {
+			s.queues[user] = queue[1:]
+			s.order = append(s.order, user)
+		} else {
+			delete(s.queues, user)
+		}
+		s.waiting--
+		s.grant(t)
+	}
+	s.notifyPositions()
+}
+
+// remove takes a waiting ticket out of its user's queue. Caller holds s.mu.
+func (s *Scheduler) remove(t *queueTicket) {
+	queue := s.queues[t.user]
+	for i, q := range queue {
+		if q != t {
+			continue
+		}
+		queue = append(queue[:i:i], queue[i+1:]...)
+		s.waiting--
+		if len(queue) > 0 {
+			s.queues[t.user] = queue
+			return
+		}
+		delete(s.queues, t.user)
+		for j, u := range s.order {
+			if u == t.user {
+				s.order = append(s.order[:j:j], s.order[j+1:]...)
+				break
+			}
+		}
+		return
+	}
+}
+
+// notifyPositions tells every waiting ticket where it stands, following the
+// order dispatch will serve them in. Caller holds s.mu.
+func (s *Scheduler) notifyPositions() {
+	pos := 0
+	for round := 0; ; round++ {
+		more := false
+		for _, user := range s.order {
+			queue := s.queues[user]
+			if round >= len(queue) {
+				continue
+			}
+			more = true
+			pos++
+			t := queue[round]
+			select {
+			case <-t.position: // drop the stale position
+			default:
+			}
+			t.position <- pos
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// isQueueError reports whether err means the call never reached the backend
+// because it gave up waiting for a slot.
+func isQueueError(err error) bool {
+	return errors.Is(err, errQueueTimeout) || errors.Is(err, errQueueCancelled)
+}
+
+// writeQueueRetryAfter sets the Retry-After header for a rejected call.
+func writeQueueRetryAfter(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter.Seconds())))
+}
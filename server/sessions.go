@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Session is a signed-in browser as shown to its user. The cookie value is
+// never exposed; ID is a handle derived from it.
+type Session struct {
+	ID         string    `json:"id"`
+	IP         string    `json:"ip,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastActive time.Time `json:"last_active"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+// sessionHandle returns the public ID for a session token.
+func sessionHandle(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:8])
+}
+
+// --- Database methods ---
+
+// ListSessions returns a user's unexpired sessions, most recently active
+// first. The session whose token is current is marked as such.
+func (db *DB) ListSessions(userID int, current string) ([]Session, error) {
+	rows, err := db.conn.Query(`
+		SELECT id, COALESCE(ip, ''), COALESCE(user_agent, ''), created_at, last_active, expires_at
+		FROM sessions
+		WHERE user_id = ? AND expires_at > CURRENT_TIMESTAMP
+		ORDER BY last_active DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []Session
+	for rows.Next() {
+		var s Session
+		var token string
+		if err := rows.Scan(&token, &s.IP, &s.UserAgent, &s.CreatedAt, &s.LastActive, &s.ExpiresAt); err != nil {
+			return nil, err
+		}
+		s.ID = sessionHandle(token)
+		s.Current = current != "" && token == current
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteSessionByHandle revokes one of a user's sessions by its public ID and
+// returns the token it held. Returns sql.ErrNoRows if there is no such session.
+func (db *DB) DeleteSessionByHandle(userID int, handle string) (string, error) {
+	rows, err := db.conn.Query(`SELECT id FROM sessions WHERE user_id = ?`, userID)
+	if err != nil {
+		return "", err
+	}
+	var token string
+	for rows.Next() {
+		var t string
+		if err := rows.Scan(&t); err != nil {
+			rows.Close()
+			return "", err
+		}
+		if sessionHandle(t) == handle {
+			token = t
+			break
+		}
+	}
+	rows.Close()
+	if token == "" {
+		return "", sql.ErrNoRows
+	}
+	if err := db.DeleteSession(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// DeleteOtherSessions revokes all of a user's sessions except keep (which may
+// be empty, revoking them all). Returns the number revoked.
+func (db *DB) DeleteOtherSessions(userID int, keep string) (int64, error) {
+	result, err := db.conn.Exec(`DELETE FROM sessions WHERE user_id = ? AND id != ?`, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// currentSessionToken returns the session cookie sent with the request, if any.
+func currentSessionToken(r *http.Request) string {
+	if cookie, err := r.Cookie("session"); err == nil {
+		return cookie.Value
+	}
+	return ""
+}
+
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+	})
+}
+
+// --- Handlers ---
+
+// handleListSessions handles GET /api/auth/sessions
+func handleListSessions(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sessions, err := db.ListSessions(UserFromContext(r.Context()).ID, currentSessionToken(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list sessions"})
+			return
+		}
+		if sessions == nil {
+			sessions = []Session{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"sessions": sessions})
+	}
+}
+
+// handleRevokeSession handles DELETE /api/auth/sessions/{id}. Revoking the
+// current session signs the caller out.
+func handleRevokeSession(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, err := db.DeleteSessionByHandle(UserFromContext(r.Context()).ID, r.PathValue("id"))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to revoke session"})
+			return
+		}
+		if token == currentSessionToken(r) {
+			clearSessionCookie(w)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+	}
+}
+
+// handleRevokeOtherSessions handles DELETE /api/auth/sessions, signing out
+// everywhere except the current browser.
+func handleRevokeOtherSessions(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		n, err := db.DeleteOtherSessions(UserFromContext(r.Context()).ID, currentSessionToken(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to revoke sessions"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"revoked": n})
+	}
+}
+
+// sessionTargetUser resolves the {id} path value of an admin sessions route.
+func sessionTargetUser(w http.ResponseWriter, r *http.Request, db *DB) (*User, bool) {
+	var id int
+	if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+		return nil, false
+	}
+	target, err := db.GetUserByID(id)
+	if err != nil || target == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+		return nil, false
+	}
+	return target, true
+}
+
+// handleAdminListSessions handles GET /api/admin/users/{id}/sessions
+func handleAdminListSessions(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, ok := sessionTargetUser(w, r, db)
+		if !ok {
+			return
+		}
+		sessions, err := db.ListSessions(target.ID, currentSessionToken(r))
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list sessions"})
+			return
+		}
+		if sessions == nil {
+			sessions = []Session{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"sessions": sessions})
+	}
+}
+
+// handleAdminRevokeSession handles DELETE /api/admin/users/{id}/sessions/{sid}
+func handleAdminRevokeSession(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, ok := sessionTargetUser(w, r, db)
+		if !ok {
+			return
+		}
+		token, err := db.DeleteSessionByHandle(target.ID, r.PathValue("sid"))
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "session not found"})
+			return
+		}
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to revoke session"})
+			return
+		}
+		if token == currentSessionToken(r) {
+			clearSessionCookie(w)
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "revoked"})
+	}
+}
+
+// handleAdminRevokeSessions handles DELETE /api/admin/users/{id}/sessions,
+// signing the user out everywhere. An admin targeting themselves keeps the
+// session they are using.
+func handleAdminRevokeSessions(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		target, ok := sessionTargetUser(w, r, db)
+		if !ok {
+			return
+		}
+		keep := ""
+		if target.ID == UserFromContext(r.Context()).ID {
+			keep = currentSessionToken(r)
+		}
+		n, err := db.DeleteOtherSessions(target.ID, keep)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to revoke sessions"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"revoked": n})
+	}
+}
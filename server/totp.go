@@ -0,0 +1,542 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters. These are the RFC 6238 defaults, which every
+// authenticator app supports.
+const (
+	totpDigits = 6
+	totpPeriod = 30 // seconds
+	totpSkew   = 1  // steps of clock drift accepted either side
+
+	recoveryCodeCount = 10
+
+	loginChallengeTTL         = 5 * time.Minute
+	loginChallengeMaxAttempts = 5
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// newTOTPSecret returns a random 160-bit secret, base32-encoded as
+// authenticator apps expect.
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// totpCode computes the code for a time step (RFC 4226 HOTP with the step as counter).
+func totpCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("decoding TOTP secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1_000_000), nil
+}
+
+// totpStep returns the time step a moment falls in.
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// matchTOTP returns the time step near now that code is valid for, or 0 if none.
+func matchTOTP(secret, code string, now time.Time) int64 {
+	current := totpStep(now)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		want, err := totpCode(secret, step)
+		if err != nil {
+			return 0
+		}
+		if hmac.Equal([]byte(want), []byte(code)) {
+			return step
+		}
+	}
+	return 0
+}
+
+// totpURI builds the otpauth:// provisioning URI that authenticator apps
+// read from a QR code.
+func totpURI(issuer, account, secret string) string {
+	q := url.Values{}
+	q.Set("secret", secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprint(totpDigits))
+	q.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + q.Encode()
+}
+
+// newRecoveryCodes returns fresh one-time recovery codes like "3f9a1-c07e2".
+func newRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		h, err := randomHex(5)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = h[:5] + "-" + h[5:]
+	}
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code as typed, ignoring case, spaces and dashes.
+func hashRecoveryCode(code string) string {
+	code = strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != totpDigits {
+		return false
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// adminTwoFactorRequired reports whether admins must have 2FA enabled.
+func adminTwoFactorRequired(db *DB) bool {
+	v, _ := db.GetConfig("require_admin_2fa")
+	return v == "true"
+}
+
+// --- Database methods ---
+
+// getTOTP returns a user's TOTP secret (pending or enabled) and whether it is enabled.
+func (db *DB) getTOTP(userID int) (secret string, enabled bool, err error) {
+	var s sql.NullString
+	err = db.conn.QueryRow(`SELECT totp_secret, totp_enabled FROM users WHERE id = ?`, userID).Scan(&s, &enabled)
+	return s.String, enabled, err
+}
+
+// SetPendingTOTPSecret stores a secret that becomes active once the user
+// confirms it with a code.
+func (db *DB) SetPendingTOTPSecret(userID int, secret string) error {
+	_, err := db.conn.Exec(`UPDATE users SET totp_secret = ? WHERE id = ? AND NOT totp_enabled`, secret, userID)
+	return err
+}
+
+// EnableTOTP turns on 2FA with the pending secret and replaces the user's
+// recovery codes. step is the time step of the code that confirmed it.
+func (db *DB) EnableTOTP(userID int, step int64, recoveryCodes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`UPDATE users SET totp_enabled = TRUE, totp_last_step = ? WHERE id = ?`, step, userID); err != nil {
+		return err
+	}
+	if err := replaceRecoveryCodes(tx, userID, recoveryCodes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP turns off 2FA and removes the secret and recovery codes.
+func (db *DB) DisableTOTP(userID int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`
+		UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_step = 0 WHERE id = ?
+	`, userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes invalidates a user's recovery codes and stores new ones.
+func (db *DB) ReplaceRecoveryCodes(userID int, codes []string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(tx, userID, codes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func replaceRecoveryCodes(tx *sql.Tx, userID int, codes []string) error {
+	if _, err := tx.Exec(`DELETE FROM recovery_codes WHERE user_id = ?`, userID); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec(`
+			INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)
+		`, userID, hashRecoveryCode(code)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns how many unused recovery codes a user has left.
+func (db *DB) CountRecoveryCodes(userID int) (int, error) {
+	var n int
+	err := db.conn.QueryRow(`
+		SELECT COUNT(*) FROM recovery_codes WHERE user_id = ? AND used_at IS NULL
+	`, userID).Scan(&n)
+	return n, err
+}
+
+// VerifySecondFactor checks a TOTP code or an unused recovery code for a
+// user with 2FA enabled. Each TOTP code and recovery code works only once.
+func (db *DB) VerifySecondFactor(userID int, code string) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+	if !isTOTPCode(code) {
+		result, err := db.conn.Exec(`
+			UPDATE recovery_codes SET used_at = CURRENT_TIMESTAMP
+			WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+		`, userID, hashRecoveryCode(code))
+		if err != nil {
+			return false, err
+		}
+		rows, _ := result.RowsAffected()
+		return rows == 1, nil
+	}
+
+	secret, enabled, err := db.getTOTP(userID)
+	if err != nil || !enabled {
+		return false, err
+	}
+	step := matchTOTP(secret, code, time.Now())
+	if step == 0 {
+		return false, nil
+	}
+	// Accept each step at most once so an observed code cannot be replayed
+	result, err := db.conn.Exec(`
+		UPDATE users SET totp_last_step = ? WHERE id = ? AND totp_last_step < ?
+	`, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	rows, _ := result.RowsAffected()
+	return rows == 1, nil
+}
+
+// CreateLoginChallenge issues the token that stands in for a session
+// between the password and second-factor login steps.
+func (db *DB) CreateLoginChallenge(userID int) (string, error) {
+	token, err := randomHex(32)
+	if err != nil {
+		return "", fmt.Errorf("generating challenge: %w", err)
+	}
+	now := time.Now()
+	db.conn.Exec(`DELETE FROM login_challenges WHERE expires_at <= ?`, now)
+	_, err = db.conn.Exec(`
+		INSERT INTO login_challenges (id, user_id, expires_at) VALUES (?, ?, ?)
+	`, token, userID, now.Add(loginChallengeTTL))
+	if err != nil {
+		return "", fmt.Errorf("inserting challenge: %w", err)
+	}
+	return token, nil
+}
+
+// UseLoginChallenge counts an attempt against a challenge and returns its
+// user ID, or 0 if the challenge is unknown, expired or out of attempts.
+func (db *DB) UseLoginChallenge(token string) (int, error) {
+	var userID, attempts int
+	var expiresAt time.Time
+	err := db.conn.QueryRow(`
+		SELECT user_id, attempts, expires_at FROM login_challenges WHERE id = ?
+	`, token).Scan(&userID, &attempts, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if time.Now().After(expiresAt) || attempts >= loginChallengeMaxAttempts {
+		db.DeleteLoginChallenge(token)
+		return 0, nil
+	}
+	if _, err := db.conn.Exec(`UPDATE login_challenges SET attempts = attempts + 1 WHERE id = ?`, token); err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+// DeleteLoginChallenge removes a challenge once it has been used.
+func (db *DB) DeleteLoginChallenge(token string) error {
+	_, err := db.conn.Exec(`DELETE FROM login_challenges WHERE id = ?`, token)
+	return err
+}
+
+// --- HTTP handlers ---
+
+// handleTwoFactorStatus handles GET /api/auth/2fa
+func handleTwoFactorStatus(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		remaining, err := db.CountRecoveryCodes(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load 2FA status"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"enabled":                  user.TwoFactorEnabled,
+			"required":                 user.IsAdmin && adminTwoFactorRequired(db),
+			"recovery_codes_remaining": remaining,
+		})
+	}
+}
+
+// handleTwoFactorSetup handles POST /api/auth/2fa/setup. It generates a new
+// secret to be confirmed through /api/auth/2fa/enable.
+func handleTwoFactorSetup(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		if user.TwoFactorEnabled {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, err := newTOTPSecret()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to generate secret"})
+			return
+		}
+		if err := db.SetPendingTOTPSecret(user.ID, secret); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save secret"})
+			return
+		}
+
+		issuer, _ := db.GetConfig("server_name")
+		if issuer == "" {
+			issuer = "Fireside"
+		}
+		writeJSON(w, http.StatusOK, map[string]string{
+			"secret":      secret,
+			"otpauth_uri": totpURI(issuer, user.Username, secret),
+		})
+	}
+}
+
+// handleTwoFactorEnable handles POST /api/auth/2fa/enable. The recovery
+// codes are returned once and only their hashes are kept.
+func handleTwoFactorEnable(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if user.TwoFactorEnabled {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is already enabled"})
+			return
+		}
+
+		secret, _, err := db.getTOTP(user.ID)
+		if err != nil || secret == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "start setup first"})
+			return
+		}
+		step := matchTOTP(secret, strings.TrimSpace(req.Code), time.Now())
+		if step == 0 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid code"})
+			return
+		}
+
+		codes, err := newRecoveryCodes()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to generate recovery codes"})
+			return
+		}
+		if err := db.EnableTOTP(user.ID, step, codes); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to enable two-factor authentication"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"status": "enabled", "recovery_codes": codes})
+	}
+}
+
+// handleTwoFactorDisable handles POST /api/auth/2fa/disable
+func handleTwoFactorDisable(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var req struct {
+			Password string `json:"password"`
+			Code     string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if !user.TwoFactorEnabled {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is not enabled"})
+			return
+		}
+		if user.IsAdmin && adminTwoFactorRequired(db) {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "two-factor authentication is required for admin accounts"})
+			return
+		}
+
+		authUser, err := db.Authenticate(user.Username, req.Password)
+		if err != nil || authUser == nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "password is incorrect"})
+			return
+		}
+		if ok, err := db.VerifySecondFactor(user.ID, req.Code); err != nil || !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid code"})
+			return
+		}
+
+		if err := db.DisableTOTP(user.ID); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to disable two-factor authentication"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "disabled"})
+	}
+}
+
+// handleRegenerateRecoveryCodes handles POST /api/auth/2fa/recovery-codes
+func handleRegenerateRecoveryCodes(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var req struct {
+			Code string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if !user.TwoFactorEnabled {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "two-factor authentication is not enabled"})
+			return
+		}
+		if ok, err := db.VerifySecondFactor(user.ID, req.Code); err != nil || !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid code"})
+			return
+		}
+
+		codes, err := newRecoveryCodes()
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to generate recovery codes"})
+			return
+		}
+		if err := db.ReplaceRecoveryCodes(user.ID, codes); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to save recovery codes"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"recovery_codes": codes})
+	}
+}
+
+// handleLoginTwoFactor handles POST /api/auth/login/2fa, the second login
+// step: it trades the challenge from handleLogin and a TOTP or recovery
+// code for a session.
+func handleLoginTwoFactor(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := getIP(r)
+		if !checkRateLimit(ip) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many attempts. Try again in 15 minutes."})
+			return
+		}
+
+		var req struct {
+			Challenge string `json:"challenge"`
+			Code      string `json:"code"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+
+		userID, err := db.UseLoginChallenge(req.Challenge)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+			return
+		}
+		if userID == 0 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "login challenge is invalid or expired; sign in again"})
+			return
+		}
+		ok, err := db.VerifySecondFactor(userID, req.Code)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+			return
+		}
+		if !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid code"})
+			return
+		}
+
+		db.DeleteLoginChallenge(req.Challenge)
+		resetRateLimit(ip)
+		user, err := db.GetUserByID(userID)
+		if err != nil || user == nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+			return
+		}
+		startSession(w, r, db, user)
+	}
+}
+
+// handleAdminResetTwoFactor handles DELETE /api/admin/users/{id}/2fa, for
+// users who have lost both their authenticator and recovery codes.
+func handleAdminResetTwoFactor(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+			return
+		}
+
+		target, err := db.GetUserByID(id)
+		if err != nil || target == nil {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+			return
+		}
+		if err := db.DisableTOTP(id); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to reset two-factor authentication"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "reset"})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UpstreamPool spreads requests over several Ollama servers. It learns which
+// models each one hosts from /api/tags, routes each request to an upstream
+// that has the model (the least busy one when several do), and ejects
+// upstreams that fail consecutive health probes until they recover.
+type UpstreamPool struct {
+	upstreams   []*upstream
+	maxFailures int // consecutive failed probes before an upstream is ejected
+}
+
+type upstream struct {
+	client   *OllamaClient
+	inflight atomic.Int64
+
+	mu       sync.Mutex
+	healthy  bool
+	failures int
+	models   map[string]bool
+}
+
+const defaultUpstreamMaxFailures = 3
+
+func NewUpstreamPool(urls []string) *UpstreamPool {
+	p := &UpstreamPool{maxFailures: defaultUpstreamMaxFailures}
+	for _, u := range urls {
+		p.upstreams = append(p.upstreams, &upstream{client: NewOllamaClient(u)})
+	}
+	return p
+}
+
+func (p *UpstreamPool) String() string {
+	urls := make([]string, len(p.upstreams))
+	for i, u := range p.upstreams {
+		urls[i] = u.client.BaseURL
+	}
+	return "ollama at " + strings.Join(urls, ", ")
+}
+
+// Refresh probes every upstream and updates its health and model list.
+func (p *UpstreamPool) Refresh() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			models, err := u.client.ListModels()
+			u.record(models, err, p.maxFailures)
+		}()
+	}
+	wg.Wait()
+}
+
+// Run probes the upstreams every interval until ctx is cancelled.
+func (p *UpstreamPool) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Refresh()
+		}
+	}
+}
+
+// record applies the outcome of a probe or model listing to u.
+func (u *upstream) record(models []Model, err error, maxFailures int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if err != nil {
+		u.failures++
+		if u.healthy && u.failures >= maxFailures {
+			u.healthy = false
+			log.Printf("Upstream %s ejected after %d failed probes: %v", u.client.BaseURL, u.failures, err)
+		}
+		return
+	}
+
+	if !u.healthy {
+		log.Printf("Upstream %s is healthy (%d models)", u.client.BaseURL, len(models))
+	}
+	u.healthy = true
+	u.failures = 0
+	u.models = make(map[string]bool, len(models))
+	for _, m := range models {
+		u.models[normalizeModelName(m.Name)] = true
+	}
+}
+
+func (u *upstream) state() (healthy bool, hasModel func(string) bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	models := u.models
+	return u.healthy, func(name string) bool { return models[normalizeModelName(name)] }
+}
+
+// pick chooses the least busy healthy upstream hosting model. When no healthy
+// upstream hosts it (or model is empty) any healthy upstream is chosen, so
+// Ollama itself reports unknown models. The returned func must be called
+// when the request finishes.
+func (p *UpstreamPool) pick(model string) (*upstream, func(), error) {
+	var best, fallback *upstream
+	for _, u := range p.upstreams {
+		healthy, hasModel := u.state()
+		if !healthy {
+			continue
+		}
+		if fallback == nil || u.inflight.Load() < fallback.inflight.Load() {
+			fallback = u
+		}
+		if model != "" && hasModel(model) && (best == nil || u.inflight.Load() < best.inflight.Load()) {
+			best = u
+		}
+	}
+	if best == nil {
+		best = fallback
+	}
+	if best == nil {
+		return nil, nil, fmt.Errorf("no healthy Ollama upstream available")
+	}
+	best.inflight.Add(1)
+	return best, func() { best.inflight.Add(-1) }, nil
+}
+
+// ollamaFor implements ollamaRouter for the Ollama-native proxy.
+func (p *UpstreamPool) ollamaFor(model string) (*OllamaClient, func(), error) {
+	u, done, err := p.pick(model)
+	if err != nil {
+		return nil, nil, err
+	}
+	return u.client, done, nil
+}
+
+// healthyUpstreams returns the upstreams that currently pass health probes.
+func (p *UpstreamPool) healthyUpstreams() []*upstream {
+	var out []*upstream
+	for _, u := range p.upstreams {
+		if healthy, _ := u.state(); healthy {
+			out = append(out, u)
+		}
+	}
+	return out
+}
+
+// ListModels returns the merged, de-duplicated model list of all healthy upstreams.
+func (p *UpstreamPool) ListModels() ([]Model, error) {
+	healthy := p.healthyUpstreams()
+	if len(healthy) == 0 {
+		return nil, fmt.Errorf("no healthy Ollama upstream available")
+	}
+
+	var merged []Model
+	seen := make(map[string]bool)
+	var lastErr error
+	listed := 0
+	for _, u := range healthy {
+		models, err := u.client.ListModels()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		u.record(models, nil, p.maxFailures)
+		listed++
+		for _, m := range models {
+			name := normalizeModelName(m.Name)
+			if !seen[name] {
+				seen[name] = true
+				merged = append(merged, m)
+			}
+		}
+	}
+	if listed == 0 {
+		return nil, lastErr
+	}
+	return merged, nil
+}
+
+// ListRunningModels returns the models loaded on every healthy upstream.
+func (p *UpstreamPool) ListRunningModels() ([]RunningModel, error) {
+	var running []RunningModel
+	for _, u := range p.healthyUpstreams() {
+		models, err := u.client.ListRunningModels()
+		if err != nil {
+			continue
+		}
+		running = append(running, models...)
+	}
+	return running, nil
+}
+
+func (p *UpstreamPool) Chat(ctx context.Context, req ChatRequest) (*ChatResponse, error) {
+	u, done, err := p.pick(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return u.client.Chat(ctx, req)
+}
+
+func (p *UpstreamPool) ChatStream(ctx context.Context, req ChatRequest, onChunk func(StreamChunk) error) error {
+	u, done, err := p.pick(req.Model)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return u.client.ChatStream(ctx, req, onChunk)
+}
+
+func (p *UpstreamPool) Embed(ctx context.Context, model string, input []string, dimensions int) (*EmbedResponse, error) {
+	u, done, err := p.pick(model)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return u.client.Embed(ctx, model, input, dimensions)
+}
+
+func (p *UpstreamPool) Generate(ctx context.Context, req GenerateRequest) (*GenerateResponse, error) {
+	u, done, err := p.pick(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return u.client.Generate(ctx, req)
+}
+
+func (p *UpstreamPool) GenerateStream(ctx context.Context, req GenerateRequest, onChunk func(GenerateResponse) error) error {
+	u, done, err := p.pick(req.Model)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return u.client.GenerateStream(ctx, req, onChunk)
+}
+
+// PullModelStream downloads the model onto the first healthy upstream, in
+// --ollama-url order, and refreshes that upstream's model list afterwards.
+func (p *UpstreamPool) PullModelStream(ctx context.Context, name string, onLine func([]byte) error) error {
+	healthy := p.healthyUpstreams()
+	if len(healthy) == 0 {
+		return fmt.Errorf("no healthy Ollama upstream available")
+	}
+	u := healthy[0]
+	err := u.client.PullModelStream(ctx, name, onLine)
+	models, listErr := u.client.ListModels()
+	u.record(models, listErr, p.maxFailures)
+	return err
+}
+
+// DeleteModel removes the model from every healthy upstream that hosts it.
+func (p *UpstreamPool) DeleteModel(name string) error {
+	deleted := false
+	for _, u := range p.healthyUpstreams() {
+		if _, hasModel := u.state(); !hasModel(name) {
+			continue
+		}
+		if err := u.client.DeleteModel(name); err != nil {
+			return fmt.Errorf("%s: %w", u.client.BaseURL, err)
+		}
+		deleted = true
+		models, err := u.client.ListModels()
+		u.record(models, err, p.maxFailures)
+	}
+	if !deleted {
+		return fmt.Errorf("model %q not found on any upstream", name)
+	}
+	return nil
+}
+
+// LoadModel loads the model on the upstream that would serve it. Unloading
+// ("0") applies to every healthy upstream hosting the model.
+func (p *UpstreamPool) LoadModel(ctx context.Context, name, keepAlive string) error {
+	if keepAlive != "0" {
+		u, done, err := p.pick(name)
+		if err != nil {
+			return err
+		}
+		defer done()
+		return u.client.LoadModel(ctx, name, keepAlive)
+	}
+
+	for _, u := range p.healthyUpstreams() {
+		if _, hasModel := u.state(); !hasModel(name) {
+			continue
+		}
+		if err := u.client.LoadModel(ctx, name, keepAlive); err != nil {
+			return fmt.Errorf("%s: %w", u.client.BaseURL, err)
+		}
+	}
+	return nil
+}
+
+// urlListFlag collects --ollama-url values. The flag may be repeated and
+// each value may hold several comma-separated URLs.
+type urlListFlag []string
+
+func (f *urlListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *urlListFlag) Set(value string) error {
+	for _, u := range strings.Split(value, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			*f = append(*f, strings.TrimSuffix(u, "/"))
+		}
+	}
+	return nil
+}
+
+// normalizeModelName applies Ollama's implicit ":latest" tag.
+func normalizeModelName(name string) string {
+	if !strings.Contains(name, ":") {
+		return name + ":latest"
+	}
+	return name
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// UsageRecord is one row of the usage ledger: a single inference call.
+type UsageRecord struct {
+	ID               int       `json:"id"`
+	UserID           int       `json:"user_id"`
+	Username         string    `json:"username,omitempty"`
+	APIKeyID         *int      `json:"api_key_id,omitempty"`
+	Source           string    `json:"source"` // "session" or "api_key"
+	Endpoint         string    `json:"endpoint"`
+	Model            string    `json:"model"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LatencyMS        int64     `json:"latency_ms"`
+	Status           string    `json:"status"` // "ok" or "error"
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// UsageSummary is one aggregated row of GET /api/admin/usage?group_by=...
+type UsageSummary struct {
+	Key              string  `json:"key"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	AvgLatencyMS     float64 `json:"avg_latency_ms"`
+}
+
+// TokenQuota holds a user's token limits. Nil means unlimited.
+type TokenQuota struct {
+	Daily   *int `json:"daily_tokens"`
+	Monthly *int `json:"monthly_tokens"`
+}
+
+// --- Database methods ---
+
+// RecordUsage appends an inference call to the usage ledger.
+func (db *DB) RecordUsage(rec UsageRecord) error {
+	_, err := db.conn.Exec(`
+		INSERT INTO usage_log (user_id, api_key_id, source, endpoint, model, prompt_tokens, completion_tokens, latency_ms, status)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, rec.UserID, rec.APIKeyID, rec.Source, rec.Endpoint, rec.Model,
+		rec.PromptTokens, rec.CompletionTokens, rec.LatencyMS, rec.Status)
+	return err
+}
+
+// TokensUsed returns the user's total tokens for the current UTC day and month.
+func (db *DB) TokensUsed(userID int) (today, thisMonth int, err error) {
+	err = db.conn.QueryRow(`
+		SELECT
+			COALESCE(SUM(CASE WHEN created_at >= date('now') THEN prompt_tokens + completion_tokens END), 0),
+			COALESCE(SUM(prompt_tokens + completion_tokens), 0)
+		FROM usage_log
+		WHERE user_id = ? AND created_at >= date('now', 'start of month')
+	`, userID).Scan(&today, &thisMonth)
+	return today, thisMonth, err
+}
+
+// GetTokenQuota returns the token limits configured for a user.
+func (db *DB) GetTokenQuota(userID int) (*TokenQuota, error) {
+	var q TokenQuota
+	err := db.conn.QueryRow(`
+		SELECT daily_token_quota, monthly_token_quota FROM users WHERE id = ?
+	`, userID).Scan(&q.Daily, &q.Monthly)
+	if err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// SetTokenQuota replaces a user's token limits.
+func (db *DB) SetTokenQuota(userID int, q TokenQuota) error {
+	result, err := db.conn.Exec(`
+		UPDATE users SET daily_token_quota = ?, monthly_token_quota = ? WHERE id = ?
+	`, q.Daily, q.Monthly, userID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// usageGroupColumns maps the group_by query parameter to the SQL expression it groups on.
+var usageGroupColumns = map[string]string{
+	"user":  "COALESCE(users.username, CAST(usage_log.user_id AS TEXT))",
+	"model": "usage_log.model",
+	"day":   "date(usage_log.created_at)",
+}
+
+// SummarizeUsage aggregates ledger rows in [from, to) by user, model or day.
+func (db *DB) SummarizeUsage(groupBy, from, to string) ([]UsageSummary, error) {
+	col, ok := usageGroupColumns[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown group_by %q", groupBy)
+	}
+
+	rows, err := db.conn.Query(`
+		SELECT `+col+` AS k,
+			COUNT(*),
+			SUM(CASE WHEN usage_log.status = 'error' THEN 1 ELSE 0 END),
+			COALESCE(SUM(usage_log.prompt_tokens), 0),
+			COALESCE(SUM(usage_log.completion_tokens), 0),
+			COALESCE(AVG(usage_log.latency_ms), 0)
+		FROM usage_log LEFT JOIN users ON users.id = usage_log.user_id
+		WHERE usage_log.created_at >= ? AND usage_log.created_at < ?
+		GROUP BY k ORDER BY k
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UsageSummary
+	for rows.Next() {
+		var s UsageSummary
+		if err := rows.Scan(&s.Key, &s.Requests, &s.Errors, &s.PromptTokens, &s.CompletionTokens, &s.AvgLatencyMS); err != nil {
+			return nil, err
+		}
+		s.TotalTokens = s.PromptTokens + s.CompletionTokens
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// ListUsage returns raw ledger rows in [from, to), newest first.
+func (db *DB) ListUsage(from, to string) ([]UsageRecord, error) {
+	rows, err := db.conn.Query(`
+		SELECT usage_log.id, usage_log.user_id, COALESCE(users.username, ''), usage_log.api_key_id,
+			usage_log.source, usage_log.endpoint, usage_log.model, usage_log.prompt_tokens,
+			usage_log.completion_tokens, usage_log.latency_ms, usage_log.status, usage_log.created_at
+		FROM usage_log LEFT JOIN users ON users.id = usage_log.user_id
+		WHERE usage_log.created_at >= ? AND usage_log.created_at < ?
+		ORDER BY usage_log.created_at DESC, usage_log.id DESC
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []UsageRecord
+	for rows.Next() {
+		var u UsageRecord
+		if err := rows.Scan(&u.ID, &u.UserID, &u.Username, &u.APIKeyID, &u.Source, &u.Endpoint, &u.Model,
+			&u.PromptTokens, &u.CompletionTokens, &u.LatencyMS, &u.Status, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// --- Recording helper ---
+
+// recordUsage writes a ledger row for the inference call made on behalf of r.
+// Failures are not fatal to the request, so the write error is ignored.
+func recordUsage(db *DB, r *http.Request, model string, start time.Time, promptTokens, completionTokens int, callErr error) {
+	user := UserFromContext(r.Context())
+	if user == nil {
+		return
+	}
+
+	rec := UsageRecord{
+		UserID:           user.ID,
+		Source:           "session",
+		Endpoint:         r.URL.Path,
+		Model:            model,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		LatencyMS:        time.Since(start).Milliseconds(),
+		Status:           "ok",
+	}
+	if key := APIKeyFromContext(r.Context()); key != nil {
+		rec.Source = "api_key"
+		rec.APIKeyID = &key.ID
+	}
+	if callErr != nil {
+		rec.Status = "error"
+	}
+	db.RecordUsage(rec)
+}
+
+// --- Middleware ---
+
+// requireQuota rejects inference requests from users who have used up their
+// daily or monthly token quota. It must run inside requireAuth or requireAPIKey.
+func requireQuota(db *DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// reject answers in the OpenAI error shape for API clients, plain JSON otherwise
+		reject := func(status int, errType, msg string) {
+			if APIKeyFromContext(r.Context()) != nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(status)
+				json.NewEncoder(w).Encode(map[string]any{
+					"error": map[string]any{
+						"message": msg,
+						"type":    errType,
+						"code":    errType,
+					},
+				})
+				return
+			}
+			writeJSON(w, status, map[string]string{"error": msg})
+		}
+
+		// A request that can't be metered is refused rather than let through
+		user := UserFromContext(r.Context())
+		quota, err := db.GetTokenQuota(user.ID)
+		if err != nil {
+			log.Printf("Quota check for user %d failed: %v", user.ID, err)
+			reject(http.StatusServiceUnavailable, "server_error", "Could not check your token quota. Please try again.")
+			return
+		}
+		if quota.Daily == nil && quota.Monthly == nil {
+			next(w, r)
+			return
+		}
+
+		today, thisMonth, err := db.TokensUsed(user.ID)
+		if err != nil {
+			log.Printf("Quota check for user %d failed: %v", user.ID, err)
+			reject(http.StatusServiceUnavailable, "server_error", "Could not check your token quota. Please try again.")
+			return
+		}
+
+		switch {
+		case quota.Daily != nil && today >= *quota.Daily:
+			reject(http.StatusTooManyRequests, "insufficient_quota", fmt.Sprintf("Daily token quota of %d exceeded. It resets at midnight UTC.", *quota.Daily))
+		case quota.Monthly != nil && thisMonth >= *quota.Monthly:
+			reject(http.StatusTooManyRequests, "insufficient_quota", fmt.Sprintf("Monthly token quota of %d exceeded. It resets on the 1st (UTC).", *quota.Monthly))
+		default:
+			next(w, r)
+		}
+	}
+}
+
+// --- HTTP handlers ---
+
+// handleAdminUsage reports the usage ledger, either raw or grouped by user, model or day.
+// Query parameters: group_by (user|model|day), from/to (YYYY-MM-DD, to is inclusive), format (json|csv).
+func handleAdminUsage(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		now := time.Now().UTC()
+
+		from := now.AddDate(0, 0, -30)
+		if v := q.Get("from"); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid from date (use YYYY-MM-DD)"})
+				return
+			}
+			from = t
+		}
+		to := now
+		if v := q.Get("to"); v != "" {
+			t, err := time.Parse("2006-01-02", v)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid to date (use YYYY-MM-DD)"})
+				return
+			}
+			to = t
+		}
+		fromStr := from.Format("2006-01-02")
+		toStr := to.AddDate(0, 0, 1).Format("2006-01-02")
+
+		groupBy := q.Get("group_by")
+		asCSV := q.Get("format") == "csv"
+
+		if groupBy == "" {
+			records, err := db.ListUsage(fromStr, toStr)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to load usage"})
+				return
+			}
+			if asCSV {
+				writeUsageCSV(w, "usage.csv", []string{"id", "created_at", "user_id", "username", "api_key_id", "source", "endpoint", "model", "prompt_tokens", "completion_tokens", "latency_ms", "status"}, len(records), func(i int) []string {
+					u := records[i]
+					keyID := ""
+					if u.APIKeyID != nil {
+						keyID = strconv.Itoa(*u.APIKeyID)
+					}
+					return []string{
+						strconv.Itoa(u.ID), u.CreatedAt.UTC().Format(time.RFC3339), strconv.Itoa(u.UserID), u.Username, keyID,
+						u.Source, u.Endpoint, u.Model, strconv.Itoa(u.PromptTokens), strconv.Itoa(u.CompletionTokens),
+						strconv.FormatInt(u.LatencyMS, 10), u.Status,
+					}
+				})
+				return
+			}
+			if records == nil {
+				records = []UsageRecord{}
+			}
+			writeJSON(w, http.StatusOK, map[string]any{"usage": records})
+			return
+		}
+
+		if _, ok := usageGroupColumns[groupBy]; !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "group_by must be one of user, model, day"})
+			return
+		}
+		summary, err := db.SummarizeUsage(groupBy, fromStr, toStr)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to summarize usage"})
+			return
+		}
+		if asCSV {
+			writeUsageCSV(w, "usage-by-"+groupBy+".csv", []string{groupBy, "requests", "errors", "prompt_tokens", "completion_tokens", "total_tokens", "avg_latency_ms"}, len(summary), func(i int) []string {
+				s := summary[i]
+				return []string{
+					s.Key, strconv.Itoa(s.Requests), strconv.Itoa(s.Errors), strconv.Itoa(s.PromptTokens),
+					strconv.Itoa(s.CompletionTokens), strconv.Itoa(s.TotalTokens), strconv.FormatFloat(s.AvgLatencyMS, 'f', 1, 64),
+				}
+			})
+			return
+		}
+		if summary == nil {
+			summary = []UsageSummary{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"group_by": groupBy, "usage": summary})
+	}
+}
+
+// writeUsageCSV streams a CSV attachment with the given header and n rows.
+func writeUsageCSV(w http.ResponseWriter, filename string, header []string, n int, row func(int) []string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for i := 0; i < n; i++ {
+		cw.Write(row(i))
+	}
+	cw.Flush()
+}
+
+// handleSetUserQuota sets or clears a user's daily and monthly token quotas (null = unlimited).
+func handleSetUserQuota(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid user ID"})
+			return
+		}
+
+		var req TokenQuota
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		if (req.Daily != nil && *req.Daily < 0) || (req.Monthly != nil && *req.Monthly < 0) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "quotas must be positive or null"})
+			return
+		}
+
+		if err := db.SetTokenQuota(id, req); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "user not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to update quota"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"user_id": id, "quota": req})
+	}
+}
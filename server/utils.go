@@ -56,7 +56,7 @@ func randomURLSafe(n int) (string, error) {
 
 // --- Time Helpers ---
 
-// parseDuration handles "24h", "7d", "30d" style durations.
+// parseDuration handles "30m", "24h", "7d" style durations.
 func parseDuration(s string) (time.Duration, error) {
 	if len(s) < 2 {
 		return 0, fmt.Errorf("too short")
@@ -70,11 +70,13 @@ func parseDuration(s string) (time.Duration, error) {
 	}
 
 	switch unit {
+	case 'm':
+		return time.Duration(num) * time.Minute, nil
 	case 'h':
 		return time.Duration(num) * time.Hour, nil
 	case 'd':
 		return time.Duration(num) * 24 * time.Hour, nil
 	default:
-		return 0, fmt.Errorf("unknown unit %q (use 'h' or 'd')", string(unit))
+		return 0, fmt.Errorf("unknown unit %q (use 'm', 'h' or 'd')", string(unit))
 	}
 }
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Passkey is a WebAuthn credential registered to a user.
+type Passkey struct {
+	ID           int        `json:"id"`
+	UserID       int        `json:"-"`
+	Name         string     `json:"name"`
+	CredentialID []byte     `json:"-"`
+	PublicKey    []byte     `json:"-"` // COSE_Key
+	SignCount    uint32     `json:"-"`
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsed     *time.Time `json:"last_used_at,omitempty"`
+}
+
+// passkeyChallengeTTL is how long a registration or login ceremony may take.
+const passkeyChallengeTTL = 5 * time.Minute
+
+// Authenticator data flags.
+const (
+	authFlagUserPresent  = 0x01
+	authFlagUserVerified = 0x04
+	authFlagAttested     = 0x40
+)
+
+// relyingParty identifies this server to authenticators. Both values come
+// from the request, so passkeys work on localhost and behind the tunnel.
+type relyingParty struct {
+	ID     string // host name, e.g. "fireside.example.com"
+	Origin string // e.g. "https://fireside.example.com"
+}
+
+func relyingPartyFor(r *http.Request) relyingParty {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("Cf-Connecting-Ip") != "" || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	id := r.Host
+	if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		id = host
+	}
+	return relyingParty{ID: id, Origin: scheme + "://" + r.Host}
+}
+
+// checkClientData validates clientDataJSON for a ceremony of the given type
+// ("webauthn.create" or "webauthn.get") and returns its challenge.
+func (rp relyingParty) checkClientData(raw []byte, typ string) (string, error) {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	if err := json.Unmarshal(raw, &cd); err != nil {
+		return "", fmt.Errorf("invalid client data: %w", err)
+	}
+	if cd.Type != typ {
+		return "", fmt.Errorf("unexpected ceremony type %q", cd.Type)
+	}
+	if cd.Origin != rp.Origin {
+		return "", fmt.Errorf("origin %q does not match %q", cd.Origin, rp.Origin)
+	}
+	return cd.Challenge, nil
+}
+
+// authenticatorData is the parsed authData of an attestation or assertion.
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	// Present on registration only
+	credentialID []byte
+	publicKey    []byte // raw COSE_Key
+	key          *coseKey
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+	ad := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if ad.flags&authFlagAttested == 0 {
+		return ad, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data too short")
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18])) // after the 16-byte AAGUID
+	rest = rest[18:]
+	if len(rest) < idLen {
+		return nil, errors.New("credential ID truncated")
+	}
+	ad.credentialID = rest[:idLen]
+	key, after, err := parseCOSEKey(rest[idLen:])
+	if err != nil {
+		return nil, err
+	}
+	ad.key = key
+	ad.publicKey = rest[idLen : len(rest)-len(after)]
+	return ad, nil
+}
+
+// check verifies the authenticator data belongs to this relying party and
+// that the user was present.
+func (ad *authenticatorData) check(rp relyingParty) error {
+	want := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(ad.rpIDHash, want[:]) {
+		return errors.New("credential is for a different site")
+	}
+	if ad.flags&authFlagUserPresent == 0 {
+		return errors.New("user presence was not confirmed")
+	}
+	return nil
+}
+
+// decodeBase64URL decodes the unpadded base64url used by WebAuthn JSON,
+// tolerating padding.
+func decodeBase64URL(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// passkeyUserHandle is the opaque user.id handed to authenticators.
+func passkeyUserHandle(userID int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(userID)))
+}
+
+// passkeyCredential is a PublicKeyCredential as serialized by the browser,
+// with binary fields base64url-encoded.
+type passkeyCredential struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    string `json:"clientDataJSON"`
+		AttestationObject string `json:"attestationObject"` // registration
+		AuthenticatorData string `json:"authenticatorData"` // login
+		Signature         string `json:"signature"`         // login
+		UserHandle        string `json:"userHandle"`        // login
+	} `json:"response"`
+}
+
+// --- Database methods ---
+
+// CreateWebAuthnChallenge stores a single-use challenge for a registration
+// or login ceremony. userID is 0 for logins that don't name a user.
+func (db *DB) CreateWebAuthnChallenge(userID int, purpose string) (string, error) {
+	challenge, err := randomURLSafe(32)
+	if err != nil {
+		return "", fmt.Errorf("generating challenge: %w", err)
+	}
+	challenge = strings.TrimRight(challenge, "=")
+
+	var owner *int
+	if userID != 0 {
+		owner = &userID
+	}
+	now := time.Now()
+	db.conn.Exec(`DELETE FROM webauthn_challenges WHERE expires_at <= ?`, now)
+	_, err = db.conn.Exec(`
+		INSERT INTO webauthn_challenges (challenge, user_id, purpose, expires_at) VALUES (?, ?, ?, ?)
+	`, challenge, owner, purpose, now.Add(passkeyChallengeTTL))
+	if err != nil {
+		return "", fmt.Errorf("inserting challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// ConsumeWebAuthnChallenge deletes a challenge and returns the user it was
+// issued to (0 if none). ok is false if it is unknown, expired or for
+// another purpose.
+func (db *DB) ConsumeWebAuthnChallenge(challenge, purpose string) (userID int, ok bool, err error) {
+	var owner sql.NullInt64
+	var expiresAt time.Time
+	err = db.conn.QueryRow(`
+		SELECT user_id, expires_at FROM webauthn_challenges WHERE challenge = ? AND purpose = ?
+	`, challenge, purpose).Scan(&owner, &expiresAt)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	result, err := db.conn.Exec(`DELETE FROM webauthn_challenges WHERE challenge = ?`, challenge)
+	if err != nil {
+		return 0, false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 || time.Now().After(expiresAt) {
+		return 0, false, nil // used concurrently, or expired
+	}
+	return int(owner.Int64), true, nil
+}
+
+// CreatePasskey stores a newly registered credential.
+func (db *DB) CreatePasskey(p *Passkey) error {
+	result, err := db.conn.Exec(`
+		INSERT INTO passkeys (user_id, name, credential_id, public_key, sign_count) VALUES (?, ?, ?, ?, ?)
+	`, p.UserID, p.Name, p.CredentialID, p.PublicKey, p.SignCount)
+	if err != nil {
+		return fmt.Errorf("inserting passkey: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	p.ID = int(id)
+	p.CreatedAt = time.Now().UTC()
+	return nil
+}
+
+const passkeyColumns = `id, user_id, name, credential_id, public_key, sign_count, created_at, last_used_at`
+
+func scanPasskey(row interface{ Scan(...any) error }) (*Passkey, error) {
+	var p Passkey
+	if err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.CredentialID, &p.PublicKey, &p.SignCount, &p.CreatedAt, &p.LastUsed); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// GetPasskeyByCredentialID looks up a credential, or returns nil if it is unknown.
+func (db *DB) GetPasskeyByCredentialID(credentialID []byte) (*Passkey, error) {
+	p, err := scanPasskey(db.conn.QueryRow(`SELECT `+passkeyColumns+` FROM passkeys WHERE credential_id = ?`, credentialID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return p, err
+}
+
+// ListPasskeys returns a user's passkeys, oldest first.
+func (db *DB) ListPasskeys(userID int) ([]Passkey, error) {
+	rows, err := db.conn.Query(`SELECT `+passkeyColumns+` FROM passkeys WHERE user_id = ? ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		p, err := scanPasskey(rows)
+		if err != nil {
+			return nil, err
+		}
+		passkeys = append(passkeys, *p)
+	}
+	return passkeys, rows.Err()
+}
+
+// RecordPasskeyUse saves the signature counter after a successful login.
+func (db *DB) RecordPasskeyUse(id int, signCount uint32) error {
+	_, err := db.conn.Exec(`
+		UPDATE passkeys SET sign_count = ?, last_used_at = CURRENT_TIMESTAMP WHERE id = ?
+	`, signCount, id)
+	return err
+}
+
+// DeletePasskey removes one of a user's passkeys.
+func (db *DB) DeletePasskey(id, userID int) error {
+	result, err := db.conn.Exec(`DELETE FROM passkeys WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	rows, _ := result.RowsAffected()
+	if rows == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// --- HTTP handlers ---
+
+// credentialDescriptors lists passkeys in the form allowCredentials and
+// excludeCredentials expect.
+func credentialDescriptors(passkeys []Passkey) []map[string]string {
+	descriptors := make([]map[string]string, len(passkeys))
+	for i, p := range passkeys {
+		descriptors[i] = map[string]string{"type": "public-key", "id": base64.RawURLEncoding.EncodeToString(p.CredentialID)}
+	}
+	return descriptors
+}
+
+// handlePasskeyRegisterBegin handles POST /api/auth/passkeys/register/begin.
+// The response's publicKey field is the argument to navigator.credentials.create.
+func handlePasskeyRegisterBegin(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		existing, err := db.ListPasskeys(user.ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list passkeys"})
+			return
+		}
+		challenge, err := db.CreateWebAuthnChallenge(user.ID, "register")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start registration"})
+			return
+		}
+
+		rp := relyingPartyFor(r)
+		serverName, _ := db.GetConfig("server_name")
+		if serverName == "" {
+			serverName = "Fireside"
+		}
+		displayName := user.DisplayName
+		if displayName == "" {
+			displayName = user.Username
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"publicKey": map[string]any{
+				"challenge": challenge,
+				"rp":        map[string]string{"id": rp.ID, "name": serverName},
+				"user": map[string]string{
+					"id":          passkeyUserHandle(user.ID),
+					"name":        user.Username,
+					"displayName": displayName,
+				},
+				"pubKeyCredParams": []map[string]any{
+					{"type": "public-key", "alg": coseES256},
+					{"type": "public-key", "alg": coseEdDSA},
+					{"type": "public-key", "alg": coseRS256},
+				},
+				"timeout":            passkeyChallengeTTL.Milliseconds(),
+				"attestation":        "none",
+				"excludeCredentials": credentialDescriptors(existing),
+				"authenticatorSelection": map[string]string{
+					"residentKey":      "required",
+					"userVerification": "preferred",
+				},
+			},
+		})
+	}
+}
+
+// handlePasskeyRegisterFinish handles POST /api/auth/passkeys/register/finish.
+// Attestation statements are not verified: we ask for "none" and only need
+// the credential's public key.
+func handlePasskeyRegisterFinish(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := UserFromContext(r.Context())
+		var req struct {
+			Name       string            `json:"name"`
+			Credential passkeyCredential `json:"credential"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		clientDataJSON, err1 := decodeBase64URL(req.Credential.Response.ClientDataJSON)
+		attestation, err2 := decodeBase64URL(req.Credential.Response.AttestationObject)
+		if err1 != nil || err2 != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "credential fields must be base64url"})
+			return
+		}
+
+		rp := relyingPartyFor(r)
+		challenge, err := rp.checkClientData(clientDataJSON, "webauthn.create")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		owner, ok, err := db.ConsumeWebAuthnChallenge(challenge, "register")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to check challenge"})
+			return
+		}
+		if !ok || owner != user.ID {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "registration challenge is invalid or expired"})
+			return
+		}
+
+		obj, _, err := decodeCBOR(attestation)
+		m, _ := obj.(map[any]any)
+		rawAuthData, _ := m["authData"].([]byte)
+		if err != nil || rawAuthData == nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid attestation object"})
+			return
+		}
+		authData, err := parseAuthenticatorData(rawAuthData)
+		if err == nil {
+			err = authData.check(rp)
+		}
+		if err == nil && authData.key == nil {
+			err = errors.New("attestation has no credential")
+		}
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		name := strings.TrimSpace(req.Name)
+		if name == "" {
+			name = "Passkey"
+		}
+		passkey := &Passkey{
+			UserID:       user.ID,
+			Name:         name,
+			CredentialID: authData.credentialID,
+			PublicKey:    authData.publicKey,
+			SignCount:    authData.signCount,
+		}
+		if err := db.CreatePasskey(passkey); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "this passkey is already registered"})
+			return
+		}
+		writeJSON(w, http.StatusCreated, map[string]any{"passkey": passkey})
+	}
+}
+
+// handleListPasskeys handles GET /api/auth/passkeys
+func handleListPasskeys(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		passkeys, err := db.ListPasskeys(UserFromContext(r.Context()).ID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to list passkeys"})
+			return
+		}
+		if passkeys == nil {
+			passkeys = []Passkey{}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"passkeys": passkeys})
+	}
+}
+
+// handleDeletePasskey handles DELETE /api/auth/passkeys/{id}
+func handleDeletePasskey(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var id int
+		if _, err := fmt.Sscanf(r.PathValue("id"), "%d", &id); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid passkey ID"})
+			return
+		}
+		if err := db.DeletePasskey(id, UserFromContext(r.Context()).ID); err != nil {
+			if err == sql.ErrNoRows {
+				writeJSON(w, http.StatusNotFound, map[string]string{"error": "passkey not found"})
+				return
+			}
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to delete passkey"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "deleted"})
+	}
+}
+
+// handlePasskeyLoginBegin handles POST /api/auth/passkeys/login/begin. With
+// no username the browser offers any passkey it holds for this site. The
+// response's publicKey field is the argument to navigator.credentials.get.
+func handlePasskeyLoginBegin(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Username string `json:"username"`
+		}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+				return
+			}
+		}
+
+		allow := []map[string]string{}
+		if req.Username != "" {
+			var userID int
+			err := db.conn.QueryRow(`SELECT id FROM users WHERE username = ?`, req.Username).Scan(&userID)
+			if err != nil && err != sql.ErrNoRows {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start login"})
+				return
+			}
+			// Unknown users get an empty list rather than an error, so usernames can't be probed
+			if passkeys, err := db.ListPasskeys(userID); err == nil {
+				allow = credentialDescriptors(passkeys)
+			}
+		}
+
+		challenge, err := db.CreateWebAuthnChallenge(0, "login")
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "failed to start login"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"publicKey": map[string]any{
+				"challenge":        challenge,
+				"rpId":             relyingPartyFor(r).ID,
+				"timeout":          passkeyChallengeTTL.Milliseconds(),
+				"userVerification": "preferred",
+				"allowCredentials": allow,
+			},
+		})
+	}
+}
+
+// handlePasskeyLoginFinish handles POST /api/auth/passkeys/login/finish. On
+// success it responds exactly like handleLogin, including the user's
+// encryption_key. A user with TOTP enabled whose authenticator did not
+// verify them (no PIN or biometric) still gets the second-factor challenge.
+func handlePasskeyLoginFinish(db *DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := getIP(r)
+		if !checkRateLimit(ip) {
+			writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "Too many attempts. Try again in 15 minutes."})
+			return
+		}
+
+		var req struct {
+			Credential passkeyCredential `json:"credential"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON"})
+			return
+		}
+		cred := req.Credential
+		credentialID, err1 := decodeBase64URL(cred.ID)
+		clientDataJSON, err2 := decodeBase64URL(cred.Response.ClientDataJSON)
+		rawAuthData, err3 := decodeBase64URL(cred.Response.AuthenticatorData)
+		signature, err4 := decodeBase64URL(cred.Response.Signature)
+		if err := errors.Join(err1, err2, err3, err4); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "credential fields must be base64url"})
+			return
+		}
+
+		rp := relyingPartyFor(r)
+		challenge, err := rp.checkClientData(clientDataJSON, "webauthn.get")
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, ok, err := db.ConsumeWebAuthnChallenge(challenge, "login"); err != nil || !ok {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "login challenge is invalid or expired"})
+			return
+		}
+
+		passkey, err := db.GetPasskeyByCredentialID(credentialID)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+			return
+		}
+		if passkey == nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unknown passkey"})
+			return
+		}
+		if cred.Response.UserHandle != "" && strings.TrimRight(cred.Response.UserHandle, "=") != passkeyUserHandle(passkey.UserID) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "passkey does not belong to this user"})
+			return
+		}
+
+		authData, err := parseAuthenticatorData(rawAuthData)
+		if err == nil {
+			err = authData.check(rp)
+		}
+		if err != nil {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": err.Error()})
+			return
+		}
+		key, _, err := parseCOSEKey(passkey.PublicKey)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "stored passkey is unreadable"})
+			return
+		}
+		clientDataHash := sha256.Sum256(clientDataJSON)
+		signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+		if !key.verify(signed, signature) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid signature"})
+			return
+		}
+		// A counter that doesn't move forward suggests a cloned authenticator.
+		// Synced passkeys always report 0.
+		if (authData.signCount != 0 || passkey.SignCount != 0) && authData.signCount <= passkey.SignCount {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "passkey signature counter went backwards"})
+			return
+		}
+		db.RecordPasskeyUse(passkey.ID, authData.signCount)
+
+		user, err := db.GetUserByID(passkey.UserID)
+		if err != nil || user == nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+			return
+		}
+		if user.TwoFactorEnabled && authData.flags&authFlagUserVerified == 0 {
+			challenge, err := db.CreateLoginChallenge(user.ID)
+			if err != nil {
+				writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "authentication failed"})
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]any{
+				"two_factor_required": true,
+				"challenge":           challenge,
+				"expires_in":          int(loginChallengeTTL.Seconds()),
+			})
+			return
+		}
+
+		resetRateLimit(ip)
+		startSession(w, r, db, user)
+	}
+}